@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds settings read from an optional JSON config file. Env vars
+// take precedence over file values.
+type Config struct {
+	Port            string
+	ListenAddr      string // host:port or unix:<path>; takes precedence over Port
+	DatabaseURL     string
+	CacheDir        string // summary images, flags, cards, and upstream bodies
+	RefreshInterval time.Duration
+	RefreshOnStart  bool // one background refresh as soon as the server listens
+	CacheTTL        time.Duration
+	HTTPTimeout     time.Duration
+	CountriesAPIURL string
+	ExchangeAPIURL  string
+	CurrencyAPIURL  string
+	APIKeys         []string
+	// Lets write endpoints through without a key when APIKeys is empty;
+	// otherwise they fail closed
+	AuthDisabled bool
+	// Browser origins allowed to call the API; "*" allows any. Empty
+	// disables CORS.
+	CORSOrigins []string
+	// Proxies trusted to report the client IP in X-Forwarded-For; empty
+	// trusts none, so the connection's address is used
+	TrustedProxies []string
+	// Hosts the server may fetch flag images from, matched exactly
+	FlagHosts []string
+	// Country names a refresh never stores, matched case-insensitively
+	ExcludeCountries []string
+	// Exchange rate providers, tried in order until one succeeds
+	RateProviders []string
+
+	// Certificate and key files for HTTPS; both empty serves plain HTTP.
+	// TLSMinVersion is tls.VersionTLS12 or tls.VersionTLS13.
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSMinVersion uint16
+
+	// Currency that exchange rates, GDP estimates, and conversions are
+	// relative to
+	BaseCurrency string
+
+	// Range the GDP estimate's random multiplier is drawn from
+	GDPMultiplierMin float64
+	GDPMultiplierMax float64
+
+	// Summary image font file (Go Regular when empty) and colors
+	ImageFont       string
+	ImageBackground color.RGBA
+	ImageForeground color.RGBA
+	ImageBarColor   color.RGBA
+}
+
+// configFile is the JSON shape of the config file; durations are strings
+// like "30m"
+type configFile struct {
+	Port            string   `json:"port"`
+	ListenAddr      string   `json:"listen_addr"`
+	TLSCertFile     string   `json:"tls_cert_file"`
+	TLSKeyFile      string   `json:"tls_key_file"`
+	TLSMinVersion   string   `json:"tls_min_version"`
+	DatabaseURL     string   `json:"database_url"`
+	CacheDir        string   `json:"cache_dir"`
+	RefreshInterval string   `json:"refresh_interval"`
+	RefreshOnStart  *bool    `json:"refresh_on_start"`
+	CacheTTL        string   `json:"cache_ttl"`
+	HTTPTimeout     string   `json:"http_timeout"`
+	CountriesAPIURL string   `json:"countries_api_url"`
+	ExchangeAPIURL  string   `json:"exchange_api_url"`
+	CurrencyAPIURL  string   `json:"currency_api_url"`
+	RateProviders   []string `json:"rate_providers"`
+	APIKeys         []string `json:"api_keys"`
+	AuthDisabled    *bool    `json:"auth_disabled"`
+	CORSOrigins     []string `json:"cors_origins"`
+	TrustedProxies  []string `json:"trusted_proxies"`
+	FlagHosts       []string `json:"flag_hosts"`
+	BaseCurrency    string   `json:"base_currency"`
+
+	ExcludeCountries []string `json:"exclude_countries"`
+	GDPMultiplierMin *float64 `json:"gdp_multiplier_min"`
+	GDPMultiplierMax *float64 `json:"gdp_multiplier_max"`
+
+	ImageFont       string `json:"image_font"`
+	ImageBackground string `json:"image_background"`
+	ImageForeground string `json:"image_foreground"`
+	ImageBarColor   string `json:"image_bar_color"`
+}
+
+// cfg is the active configuration, replaced by loadConfig at startup
+var cfg = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Port:            "8080",
+		CacheDir:        "cache",
+		TLSMinVersion:   tls.VersionTLS12,
+		CacheTTL:        10 * time.Minute,
+		HTTPTimeout:     30 * time.Second,
+		CountriesAPIURL: "https://restcountries.com",
+		ExchangeAPIURL:  "https://open.er-api.com",
+		CurrencyAPIURL:  "https://cdn.jsdelivr.net/npm/@fawazahmed0/currency-api@latest/v1",
+		RateProviders:   []string{"open-er-api", "currency-api"},
+		FlagHosts:       []string{"flagcdn.com", "upload.wikimedia.org"},
+		BaseCurrency:    "USD",
+
+		GDPMultiplierMin: 1000,
+		GDPMultiplierMax: 2000,
+
+		ImageBackground: color.RGBA{240, 248, 255, 255},
+		ImageForeground: color.RGBA{0, 0, 0, 255},
+		ImageBarColor:   color.RGBA{70, 130, 180, 255},
+	}
+}
+
+// loadConfig reads CONFIG_FILE (default config.json) if it exists, then
+// applies env overrides. A missing file is only an error when CONFIG_FILE
+// names it explicitly.
+func loadConfig() (Config, error) {
+	c := defaultConfig()
+
+	path := os.Getenv("CONFIG_FILE")
+	explicit := path != ""
+	if !explicit {
+		path = "config.json"
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := c.applyFile(data); err != nil {
+			return c, fmt.Errorf("%s: %w", path, err)
+		}
+	case !os.IsNotExist(err) || explicit:
+		return c, err
+	}
+
+	if v := os.Getenv("PORT"); v != "" {
+		c.Port = v
+	}
+	if v := os.Getenv("LISTEN_ADDR"); v != "" {
+		c.ListenAddr = v
+	}
+	if v := os.Getenv("TLS_CERT_FILE"); v != "" {
+		c.TLSCertFile = v
+	}
+	if v := os.Getenv("TLS_KEY_FILE"); v != "" {
+		c.TLSKeyFile = v
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return c, fmt.Errorf("TLS needs both a certificate and a key file")
+	}
+	if err := setTLSVersion("TLS_MIN_VERSION", os.Getenv("TLS_MIN_VERSION"), &c.TLSMinVersion); err != nil {
+		return c, err
+	}
+	if v := os.Getenv("DATABASE_URL"); v != "" {
+		c.DatabaseURL = v
+	} else if v := os.Getenv("POSTGRES_URL"); v != "" && c.DatabaseURL == "" {
+		// POSTGRES_URL is a fallback and never overrides the file
+		c.DatabaseURL = v
+	}
+	if v := os.Getenv("CACHE_DIR"); v != "" {
+		c.CacheDir = v
+	}
+	if err := setInterval("REFRESH_INTERVAL", os.Getenv("REFRESH_INTERVAL"), &c.RefreshInterval); err != nil {
+		return c, err
+	}
+	if err := setBool("REFRESH_ON_START", os.Getenv("REFRESH_ON_START"), &c.RefreshOnStart); err != nil {
+		return c, err
+	}
+	c.CacheTTL = envDuration("UPSTREAM_CACHE_TTL", c.CacheTTL)
+	c.HTTPTimeout = envDuration("HTTP_TIMEOUT", c.HTTPTimeout)
+	if c.HTTPTimeout <= 0 {
+		return c, fmt.Errorf("HTTP timeout must be positive, got %s", c.HTTPTimeout)
+	}
+	if v := os.Getenv("COUNTRIES_API_URL"); v != "" {
+		c.CountriesAPIURL = v
+	}
+	if v := os.Getenv("EXCHANGE_API_URL"); v != "" {
+		c.ExchangeAPIURL = v
+	}
+	if v := os.Getenv("CURRENCY_API_URL"); v != "" {
+		c.CurrencyAPIURL = v
+	}
+	if v := os.Getenv("RATE_PROVIDERS"); v != "" {
+		c.RateProviders = splitList(v)
+	}
+	if len(c.RateProviders) == 0 {
+		return c, fmt.Errorf("at least one rate provider is required")
+	}
+	for _, name := range c.RateProviders {
+		if _, ok := rateProviders[name]; !ok {
+			return c, fmt.Errorf("unknown rate provider %q (use %s)", name, strings.Join(slices.Sorted(maps.Keys(rateProviders)), ", "))
+		}
+	}
+	if v := os.Getenv("API_KEYS"); v != "" {
+		c.APIKeys = splitList(v)
+	}
+	if err := setBool("AUTH_DISABLED", os.Getenv("AUTH_DISABLED"), &c.AuthDisabled); err != nil {
+		return c, err
+	}
+	if c.AuthDisabled && len(c.APIKeys) > 0 {
+		return c, fmt.Errorf("AUTH_DISABLED cannot be combined with API keys")
+	}
+	if v := os.Getenv("CORS_ORIGINS"); v != "" {
+		c.CORSOrigins = splitList(v)
+	}
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		c.TrustedProxies = splitList(v)
+	}
+	if v := os.Getenv("FLAG_HOSTS"); v != "" {
+		c.FlagHosts = splitList(v)
+	}
+	if v := os.Getenv("EXCLUDE_COUNTRIES"); v != "" {
+		c.ExcludeCountries = splitList(v)
+	}
+	// Origins never end in a slash, but they are easy to paste with one
+	for i, origin := range c.CORSOrigins {
+		c.CORSOrigins[i] = strings.TrimRight(strings.TrimSpace(origin), "/")
+	}
+
+	if v := os.Getenv("BASE_CURRENCY"); v != "" {
+		c.BaseCurrency = v
+	}
+	// Whether the code is known is checked against the fetched rates
+	c.BaseCurrency = strings.ToUpper(strings.TrimSpace(c.BaseCurrency))
+	if len(c.BaseCurrency) != 3 {
+		return c, fmt.Errorf("base currency must be a 3-letter currency code, got %q", c.BaseCurrency)
+	}
+
+	c.GDPMultiplierMin = envFloat("GDP_MULTIPLIER_MIN", c.GDPMultiplierMin)
+	c.GDPMultiplierMax = envFloat("GDP_MULTIPLIER_MAX", c.GDPMultiplierMax)
+	if c.GDPMultiplierMin < 0 || c.GDPMultiplierMin > c.GDPMultiplierMax {
+		return c, fmt.Errorf("GDP multiplier range must satisfy 0 <= min <= max, got min %g and max %g",
+			c.GDPMultiplierMin, c.GDPMultiplierMax)
+	}
+
+	if v := os.Getenv("IMAGE_FONT"); v != "" {
+		c.ImageFont = v
+	}
+	for _, s := range []struct {
+		name string
+		dst  *color.RGBA
+	}{
+		{"IMAGE_BACKGROUND", &c.ImageBackground},
+		{"IMAGE_FOREGROUND", &c.ImageForeground},
+		{"IMAGE_BAR_COLOR", &c.ImageBarColor},
+	} {
+		if err := setColor(s.name, os.Getenv(s.name), s.dst); err != nil {
+			return c, err
+		}
+	}
+
+	// Paths are appended to the base URLs
+	c.CountriesAPIURL = strings.TrimRight(c.CountriesAPIURL, "/")
+	c.ExchangeAPIURL = strings.TrimRight(c.ExchangeAPIURL, "/")
+	c.CurrencyAPIURL = strings.TrimRight(c.CurrencyAPIURL, "/")
+	return c, nil
+}
+
+// applyFile overlays the non-empty values from a JSON config file.
+func (c *Config) applyFile(data []byte) error {
+	var f configFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return err
+	}
+
+	for _, s := range []struct {
+		src string
+		dst *string
+	}{
+		{f.Port, &c.Port},
+		{f.ListenAddr, &c.ListenAddr},
+		{f.TLSCertFile, &c.TLSCertFile},
+		{f.TLSKeyFile, &c.TLSKeyFile},
+		{f.DatabaseURL, &c.DatabaseURL},
+		{f.CacheDir, &c.CacheDir},
+		{f.CountriesAPIURL, &c.CountriesAPIURL},
+		{f.ExchangeAPIURL, &c.ExchangeAPIURL},
+		{f.CurrencyAPIURL, &c.CurrencyAPIURL},
+		{f.BaseCurrency, &c.BaseCurrency},
+		{f.ImageFont, &c.ImageFont},
+	} {
+		if s.src != "" {
+			*s.dst = s.src
+		}
+	}
+	if err := setTLSVersion("tls_min_version", f.TLSMinVersion, &c.TLSMinVersion); err != nil {
+		return err
+	}
+	if len(f.APIKeys) > 0 {
+		c.APIKeys = f.APIKeys
+	}
+	if f.AuthDisabled != nil {
+		c.AuthDisabled = *f.AuthDisabled
+	}
+	if len(f.CORSOrigins) > 0 {
+		c.CORSOrigins = f.CORSOrigins
+	}
+	if len(f.TrustedProxies) > 0 {
+		c.TrustedProxies = f.TrustedProxies
+	}
+	if len(f.FlagHosts) > 0 {
+		c.FlagHosts = f.FlagHosts
+	}
+	if len(f.RateProviders) > 0 {
+		c.RateProviders = f.RateProviders
+	}
+	if len(f.ExcludeCountries) > 0 {
+		c.ExcludeCountries = f.ExcludeCountries
+	}
+	if f.RefreshOnStart != nil {
+		c.RefreshOnStart = *f.RefreshOnStart
+	}
+	if f.GDPMultiplierMin != nil {
+		c.GDPMultiplierMin = *f.GDPMultiplierMin
+	}
+	if f.GDPMultiplierMax != nil {
+		c.GDPMultiplierMax = *f.GDPMultiplierMax
+	}
+	for _, s := range []struct {
+		name, src string
+		dst       *color.RGBA
+	}{
+		{"image_background", f.ImageBackground, &c.ImageBackground},
+		{"image_foreground", f.ImageForeground, &c.ImageForeground},
+		{"image_bar_color", f.ImageBarColor, &c.ImageBarColor},
+	} {
+		if err := setColor(s.name, s.src, s.dst); err != nil {
+			return err
+		}
+	}
+
+	if err := setInterval("refresh_interval", f.RefreshInterval, &c.RefreshInterval); err != nil {
+		return err
+	}
+	for _, d := range []struct {
+		name string
+		src  string
+		dst  *time.Duration
+	}{
+		{"cache_ttl", f.CacheTTL, &c.CacheTTL},
+		{"http_timeout", f.HTTPTimeout, &c.HTTPTimeout},
+	} {
+		if d.src == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.src)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration like 30m", d.name)
+		}
+		*d.dst = v
+	}
+	return nil
+}
+
+// listenNetwork returns the network and address to listen on: a unix
+// socket for "unix:<path>", otherwise TCP on ListenAddr or ":" + Port.
+func (c Config) listenNetwork() (string, string) {
+	if path, ok := strings.CutPrefix(c.ListenAddr, "unix:"); ok {
+		return "unix", path
+	}
+	if c.ListenAddr != "" {
+		return "tcp", c.ListenAddr
+	}
+	return "tcp", ":" + c.Port
+}
+
+// setInterval parses a refresh interval into dst, leaving it unchanged when
+// value is empty. A bare integer is a number of minutes; otherwise value is
+// a duration like "1h30m". Zero disables the scheduler. name is only used
+// in the error.
+func setInterval(name, value string, dst *time.Duration) error {
+	if value == "" {
+		return nil
+	}
+	v, err := time.ParseDuration(value)
+	if n, nerr := strconv.Atoi(value); nerr == nil {
+		v, err = time.Duration(n)*time.Minute, nil
+	}
+	if err != nil || v < 0 {
+		return fmt.Errorf("%s must be a number of minutes or a duration like 30m, got %q", name, value)
+	}
+	*dst = v
+	return nil
+}
+
+// setBool parses a boolean like "true" or "0" into dst, leaving it
+// unchanged when value is empty. name is only used in the error.
+func setBool(name, value string, dst *bool) error {
+	if value == "" {
+		return nil
+	}
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("%s must be true or false, got %q", name, value)
+	}
+	*dst = v
+	return nil
+}
+
+// setTLSVersion parses "1.2" or "1.3" into dst, leaving it unchanged when
+// value is empty. Older versions are refused. name is only used in the
+// error.
+func setTLSVersion(name, value string, dst *uint16) error {
+	switch value {
+	case "":
+	case "1.2":
+		*dst = tls.VersionTLS12
+	case "1.3":
+		*dst = tls.VersionTLS13
+	default:
+		return fmt.Errorf("%s must be 1.2 or 1.3, got %q", name, value)
+	}
+	return nil
+}
+
+// splitList splits a comma-separated env value, dropping blank entries.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// setColor parses a "#rrggbb" hex color into dst, leaving it unchanged
+// when value is empty. name is only used in the error.
+func setColor(name, value string, dst *color.RGBA) error {
+	if value == "" {
+		return nil
+	}
+	hex := strings.TrimPrefix(value, "#")
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 6 {
+		return fmt.Errorf("%s must be a hex color like #4682b4, got %q", name, value)
+	}
+	*dst = color.RGBA{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 255}
+	return nil
+}
+
+// hexColor formats c as "#rrggbb".
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
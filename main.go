@@ -1,39 +1,233 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	_ "embed"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"html"
 	"image"
-	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
 	"image/png"
-	"log"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
 	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang/freetype"
 	"github.com/golang/freetype/truetype"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	xdraw "golang.org/x/image/draw"
 	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // Country model
 type Country struct {
 	ID              uint      `gorm:"primaryKey" json:"id"`
-	Name            string    `gorm:"uniqueIndex;not null" json:"name"`
+	Name            string    `gorm:"size:255;uniqueIndex;not null" json:"name"`
 	Capital         string    `json:"capital"`
 	Region          string    `json:"region"`
 	Population      int64     `gorm:"not null" json:"population"`
 	CurrencyCode    *string   `json:"currency_code"`
+	CurrencySymbol  *string   `json:"currency_symbol"`
 	ExchangeRate    *float64  `json:"exchange_rate"`
 	EstimatedGDP    *float64  `json:"estimated_gdp"`
 	FlagURL         string    `json:"flag_url"`
 	LastRefreshedAt time.Time `json:"last_refreshed_at"`
+
+	// When the row last changed: by a refresh, a PATCH, or a restore
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// When the exchange API last updated the stored rates, nil when none of
+	// the country's currencies has one
+	RatesAsOf *time.Time `json:"rates_as_of"`
+	// Base currency the stored rates are relative to, so rates saved under
+	// another BASE_CURRENCY are never served as this one's
+	RatesBase string `gorm:"size:16" json:"-"`
+
+	// ISO 3166-1 alpha-2 and alpha-3 codes, and the alpha-3 codes of
+	// bordering countries
+	Alpha2Code string   `gorm:"size:2;index" json:"alpha2_code"`
+	Alpha3Code string   `gorm:"size:3;index" json:"alpha3_code"`
+	Borders    []string `gorm:"serializer:json" json:"borders"`
+
+	// Centroid, nil when upstream has none
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+
+	// Fields set via PATCH; refreshes keep them while ManualOverride is set
+	ManualOverride   bool     `gorm:"not null;default:false" json:"manual_override"`
+	OverriddenFields []string `gorm:"serializer:json" json:"overridden_fields"`
+
+	// All official currencies; CurrencyCode/ExchangeRate mirror the first
+	Currencies []CountryCurrency `gorm:"constraint:OnDelete:CASCADE" json:"currencies"`
+
+	// Soft delete; restored via POST /countries/:name/restore
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"deleted_at"`
+
+	// Derived on load, not stored
+	EstimatedGDPPerCapita *float64 `gorm:"-" json:"estimated_gdp_per_capita"`
+}
+
+// AfterFind derives EstimatedGDPPerCapita, leaving it nil when GDP or
+// population is unavailable.
+func (c *Country) AfterFind(tx *gorm.DB) error {
+	c.EstimatedGDPPerCapita = nil
+	if c.EstimatedGDP != nil && c.Population > 0 {
+		perCapita := *c.EstimatedGDP / float64(c.Population)
+		c.EstimatedGDPPerCapita = &perCapita
+	}
+	return nil
+}
+
+// MarshalJSON rounds estimated_gdp to 2 decimals and exchange_rate to 4 for
+// display; the stored values keep full precision.
+func (c Country) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.rounded())
+}
+
+// roundedCountry is how a Country is encoded. The outer fields shadow the
+// embedded ones of the same name.
+type roundedCountry struct {
+	plainCountry
+	ExchangeRate *float64 `json:"exchange_rate"`
+	EstimatedGDP *float64 `json:"estimated_gdp"`
+}
+
+// plainCountry is Country without its MarshalJSON
+type plainCountry Country
+
+func (c Country) rounded() roundedCountry {
+	return roundedCountry{plainCountry(c), roundPtr(c.ExchangeRate, 4), roundPtr(c.EstimatedGDP, 2)}
+}
+
+// roundPtr returns *v rounded to places decimals, or nil when v is nil.
+func roundPtr(v *float64, places int) *float64 {
+	if v == nil {
+		return nil
+	}
+	rounded := roundTo(*v, places)
+	return &rounded
+}
+
+func roundTo(v float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(v*scale) / scale
+}
+
+// CountryCurrency is one of a country's official currencies
+type CountryCurrency struct {
+	ID           uint     `gorm:"primaryKey" json:"-"`
+	CountryID    uint     `gorm:"index;not null" json:"-"`
+	Code         string   `gorm:"size:16;index;not null" json:"code"`
+	Symbol       *string  `gorm:"size:16" json:"symbol"`
+	ExchangeRate *float64 `json:"exchange_rate"`
+}
+
+// MarshalJSON rounds exchange_rate to 4 decimals, like Country.
+func (c CountryCurrency) MarshalJSON() ([]byte, error) {
+	type currency CountryCurrency
+	return json.Marshal(struct {
+		currency
+		ExchangeRate *float64 `json:"exchange_rate"`
+	}{currency(c), roundPtr(c.ExchangeRate, 4)})
+}
+
+// CountrySnapshot records a country's figures as captured by one refresh
+type CountrySnapshot struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	CountryName  string    `gorm:"size:255;index;not null" json:"country_name"`
+	Population   int64     `json:"population"`
+	ExchangeRate *float64  `json:"exchange_rate"`
+	EstimatedGDP *float64  `json:"estimated_gdp"`
+	CapturedAt   time.Time `gorm:"index" json:"captured_at"`
+}
+
+// MarshalJSON rounds estimated_gdp and exchange_rate like Country.
+func (s CountrySnapshot) MarshalJSON() ([]byte, error) {
+	type snapshot CountrySnapshot
+	return json.Marshal(struct {
+		snapshot
+		ExchangeRate *float64 `json:"exchange_rate"`
+		EstimatedGDP *float64 `json:"estimated_gdp"`
+	}{snapshot(s), roundPtr(s.ExchangeRate, 4), roundPtr(s.EstimatedGDP, 2)})
+}
+
+// RefreshLog records the outcome and timings of one refresh; /status shows
+// the latest
+type RefreshLog struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	StartedAt  time.Time `gorm:"index" json:"started_at"`
+	DurationMS int64     `json:"duration_ms"`
+	Success    bool      `json:"success"`
+	Error      *string   `gorm:"type:text" json:"error"`
+	Countries  int       `json:"countries"`
+
+	// Per-upstream timings, null when the source was never reached. A
+	// cached response shows up as a near-zero duration.
+	CountriesFetchMS *int64 `json:"countries_fetch_ms"`
+	CountriesFetchOK *bool  `json:"countries_fetch_ok"`
+	RatesFetchMS     *int64 `json:"rates_fetch_ms"`
+	RatesFetchOK     *bool  `json:"rates_fetch_ok"`
+}
+
+// AuditLog records a delete or restore of a country and the API key
+// that made it, or a refresh removing it for EXCLUDE_COUNTRIES
+type AuditLog struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Action      string    `gorm:"size:16;not null" json:"action"` // delete, restore, or exclude
+	CountryName string    `gorm:"size:255;not null;index" json:"country_name"`
+	APIKeyID    *string   `gorm:"size:32" json:"api_key_id"` // null when AUTH_DISABLED let the write through
+	CreatedAt   time.Time `gorm:"index" json:"created_at"`
+}
+
+// newAuditLogs builds one audit row per country name for the request's
+// API key.
+func newAuditLogs(c *gin.Context, action string, names ...string) []AuditLog {
+	var keyID *string
+	if id := c.GetString(apiKeyIDKey); id != "" {
+		keyID = &id
+	}
+	logs := make([]AuditLog, len(names))
+	for i, name := range names {
+		logs[i] = AuditLog{Action: action, CountryName: name, APIKeyID: keyID}
+	}
+	return logs
 }
 
 // External API response structures
@@ -44,41 +238,306 @@ type RestCountry struct {
 	Population int64               `json:"population"`
 	Flag       string              `json:"flag"`
 	Currencies []map[string]string `json:"currencies"`
+	Alpha2Code string              `json:"alpha2Code"`
+	Alpha3Code string              `json:"alpha3Code"`
+	Borders    []string            `json:"borders"`
+	LatLng     []float64           `json:"latlng"`
+}
+
+// RestCountryV3 is the restcountries v3.1 response shape
+type RestCountryV3 struct {
+	Name struct {
+		Common string `json:"common"`
+	} `json:"name"`
+	Capital    []string `json:"capital"`
+	Region     string   `json:"region"`
+	Population int64    `json:"population"`
+	Flags      struct {
+		SVG string `json:"svg"`
+		PNG string `json:"png"`
+	} `json:"flags"`
+	Currencies map[string]struct {
+		Name   string `json:"name"`
+		Symbol string `json:"symbol"`
+	} `json:"currencies"`
+	CCA2    string    `json:"cca2"`
+	CCA3    string    `json:"cca3"`
+	Borders []string  `json:"borders"`
+	LatLng  []float64 `json:"latlng"`
+}
+
+// toRestCountry adapts a v3.1 record to the v2 shape used for storage.
+// Currencies are keyed by code in v3.1, so they are sorted by code to keep
+// the primary currency stable.
+func (v RestCountryV3) toRestCountry() RestCountry {
+	rc := RestCountry{
+		Name:       v.Name.Common,
+		Region:     v.Region,
+		Population: v.Population,
+		Flag:       v.Flags.SVG,
+		Alpha2Code: v.CCA2,
+		Alpha3Code: v.CCA3,
+		Borders:    v.Borders,
+		LatLng:     v.LatLng,
+	}
+	if len(v.Capital) > 0 {
+		rc.Capital = v.Capital[0]
+	}
+	for _, code := range slices.Sorted(maps.Keys(v.Currencies)) {
+		cur := v.Currencies[code]
+		rc.Currencies = append(rc.Currencies, map[string]string{
+			"code":   code,
+			"name":   cur.Name,
+			"symbol": cur.Symbol,
+		})
+	}
+	return rc
 }
 
 type ExchangeRates struct {
-	Rates map[string]float64 `json:"rates"`
+	Rates          map[string]float64 `json:"rates"`
+	LastUpdateUnix int64              `json:"time_last_update_unix"`
 }
 
+// asOf returns when upstream last updated the rates, or nil if it didn't
+// say.
+func (r ExchangeRates) asOf() *time.Time {
+	if r.LastUpdateUnix <= 0 {
+		return nil
+	}
+	t := time.Unix(r.LastUpdateUnix, 0).UTC()
+	return &t
+}
+
+// APIError is the body of every error response, wrapped as {"error": ...}.
+// Code is a stable machine-readable identifier clients can switch on.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details string `json:"details,omitempty"`
+}
+
+// Error codes
+const (
+	ErrCodeInvalidParameter     = "INVALID_PARAMETER"
+	ErrCodeCountryNotFound      = "COUNTRY_NOT_FOUND"
+	ErrCodeRateNotFound         = "RATE_NOT_FOUND"
+	ErrCodeImageNotFound        = "IMAGE_NOT_FOUND"
+	ErrCodeImageUnavailable     = "IMAGE_UNAVAILABLE"
+	ErrCodeUpstreamUnavailable  = "UPSTREAM_UNAVAILABLE"
+	ErrCodeUnauthorized         = "UNAUTHORIZED"
+	ErrCodeForbidden            = "FORBIDDEN"
+	ErrCodeRateLimited          = "RATE_LIMITED"
+	ErrCodePayloadTooLarge      = "PAYLOAD_TOO_LARGE"
+	ErrCodeRefreshInProgress    = "REFRESH_IN_PROGRESS"
+	ErrCodeDatabaseTimeout      = "DATABASE_TIMEOUT"
+	ErrCodeDatabaseUnavailable  = "DATABASE_UNAVAILABLE"
+	ErrCodeInternal             = "INTERNAL_ERROR"
+	ErrCodeWarmingUp            = "WARMING_UP"
+	ErrCodePayloadNotFound      = "PAYLOAD_NOT_FOUND"
+	ErrCodeIdempotencyKeyReused = "IDEMPOTENCY_KEY_REUSED"
+)
+
 var db *gorm.DB
 
+// Last successful upstream payloads, reused within UPSTREAM_CACHE_TTL
+var (
+	countriesCache cachedValue[[]RestCountry]
+	ratesCache     cachedValue[ExchangeRates]
+)
+
 func main() {
-	// Load environment variables
+	// Structured JSON logs
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	// Load environment variables, then the optional config file
 	godotenv.Load()
+	var err error
+	if cfg, err = loadConfig(); err != nil {
+		slog.Error("Invalid config", "error", err)
+		os.Exit(1)
+	}
+	httpClient = newHTTPClient(cfg.HTTPTimeout)
+
+	// Create cache directory
+	if err := os.MkdirAll(cfg.CacheDir, 0755); err != nil {
+		slog.Error("Failed to create cache directory", "dir", cfg.CacheDir, "error", err)
+		os.Exit(1)
+	}
 
 	// Initialize database
 	initDB()
 
-	// Create cache directory
-	os.MkdirAll("cache", 0755)
-
 	// Setup Gin router
-	r := gin.Default()
+	r := gin.New()
+	// Without trusted proxies ClientIP is the peer address, so clients
+	// can't dodge the rate limits with a forged X-Forwarded-For
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		slog.Error("Invalid trusted proxies", "error", err)
+		os.Exit(1)
+	}
+	r.Use(requestLogger(), gin.Recovery(), metricsMiddleware())
+	r.Use(cors(cfg.CORSOrigins))
+	// Probes and scrapers poll from one IP, often several times a second
+	r.Use(exceptRoutes(rateLimit(envInt("RATE_LIMIT", 60)), "/status", "/health", "/metrics"))
+	r.Use(maxBodySize(envInt("MAX_BODY_BYTES", 1<<20)))
+	r.Use(gzipResponses(envInt("GZIP_MIN_SIZE", 1024)))
 
-	// Routes
-	r.POST("/countries/refresh", refreshCountries)
-	r.GET("/countries", getCountries)
+	// Routes; mutating ones require an API key, and reads of country data
+	// wait for the first refresh
+	auth := requireAPIKey(cfg.APIKeys, cfg.AuthDisabled)
+	admin := requireAdminKey(cfg.APIKeys)
+	ready := requireData()
+	r.POST("/countries/refresh", auth, rateLimit(envInt("REFRESH_RATE_LIMIT", 2)), noWriteTimeout, refreshCountries)
+	r.GET("/countries/refresh/stream", noWriteTimeout, streamRefreshProgress)
+	r.GET("/countries", ready, getCountries)
+	r.GET("/countries.csv", ready, exportCountriesCSV)
+	r.GET("/countries.jsonl", ready, exportCountriesJSONL)
 	r.GET("/countries/image", getCountryImage)
-	r.GET("/countries/:name", getCountry)
-	r.DELETE("/countries/:name", deleteCountry)
+	r.GET("/countries/image.svg", getCountryImageSVG)
+	r.GET("/countries/compare", ready, compareCountries)
+	r.POST("/countries/batch", ready, batchGetCountries)
+	r.GET("/countries/stats", ready, getCountryStats)
+	r.GET("/countries/nearby", ready, getNearbyCountries)
+	r.GET("/countries/random", ready, getRandomCountry)
+	r.GET("/countries/top", ready, getTopCountries)
+	r.GET("/countries/:name", ready, getCountry)
+	r.GET("/countries/:name/convert", ready, convertCurrency)
+	r.GET("/countries/:name/history", ready, getCountryHistory)
+	r.GET("/countries/:name/history/aggregate", ready, getCountryHistoryAggregate)
+	r.GET("/countries/:name/flag", ready, getCountryFlag)
+	r.GET("/countries/:name/flag.png", ready, getCountryCard)
+	r.GET("/countries/:name/neighbors", ready, getCountryNeighbors)
+	r.GET("/countries/:name/similar", ready, getSimilarCountries)
+	r.DELETE("/countries", auth, deleteCountries)
+	r.PATCH("/countries/:name", auth, patchCountry)
+	r.DELETE("/countries/:name", auth, deleteCountry)
+	r.DELETE("/countries/id/:id", auth, deleteCountryByID)
+	r.POST("/countries/:name/restore", auth, restoreCountry)
+	r.GET("/audit", admin, getAuditLogs)
+	r.GET("/currencies", ready, getCurrencies)
+	r.GET("/regions", ready, getRegions)
 	r.GET("/status", getStatus)
+	r.GET("/health", getHealth)
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.GET("/openapi.json", getOpenAPISpec)
+	r.GET("/debug/upstream/countries", admin, getUpstreamPayload(cacheFile(upstreamCountriesFile)))
+	r.GET("/debug/upstream/rates", admin, getUpstreamPayload(cacheFile(upstreamRatesFile)))
 
 	// Start server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	network, addr := cfg.listenNetwork()
+	if network == "unix" {
+		// A socket left behind by an unclean exit would make Listen fail
+		if info, err := os.Stat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		slog.Error("Failed to listen", "network", network, "addr", addr, "error", err)
+		os.Exit(1)
+	}
+	// WRITE_TIMEOUT bounds ordinary responses; a refresh and its progress
+	// stream lift it with noWriteTimeout
+	srv := &http.Server{
+		Handler:           r,
+		ReadHeaderTimeout: envDuration("READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       envDuration("READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      envDuration("WRITE_TIMEOUT", 60*time.Second),
+		IdleTimeout:       envDuration("IDLE_TIMEOUT", 120*time.Second),
+	}
+	if cfg.TLSCertFile != "" {
+		// Load the pair now so a bad path fails startup instead of the
+		// first handshake
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			slog.Error("Failed to load TLS certificate", "error", err)
+			os.Exit(1)
+		}
+		srv.TLSConfig = &tls.Config{MinVersion: cfg.TLSMinVersion, Certificates: []tls.Certificate{cert}}
+	}
+	srv.RegisterOnShutdown(refreshProgress.close)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Background refresh, disabled when the refresh interval is unset or 0
+	if cfg.RefreshInterval > 0 {
+		go scheduleRefresh(ctx, cfg.RefreshInterval)
+	}
+	// The listener is already open, so requests are served meanwhile
+	if cfg.RefreshOnStart {
+		go backgroundRefresh(ctx, "Startup")
+	}
+
+	go func() {
+		slog.Info("Listening", "network", network, "addr", addr, "tls", srv.TLSConfig != nil)
+		serve := srv.Serve
+		if srv.TLSConfig != nil {
+			// The certificate is already in TLSConfig
+			serve = func(l net.Listener) error { return srv.ServeTLS(l, "", "") }
+		}
+		if err := serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Server failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Wait for SIGINT/SIGTERM, then let in-flight requests drain
+	<-ctx.Done()
+	stop()
+	slog.Info("Shutting down server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), envDuration("SHUTDOWN_TIMEOUT", 15*time.Second))
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Server forced to shut down", "error", err)
+	}
+}
+
+// envInt returns the integer value of an environment variable, or def when
+// it is unset or invalid.
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		slog.Warn("Invalid environment variable, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return n
+}
+
+// envFloat returns the float value of an environment variable, or def when
+// it is unset or invalid.
+func envFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		slog.Warn("Invalid environment variable, using default", "key", key, "value", v, "default", def)
+		return def
+	}
+	return f
+}
+
+// envDuration returns the duration value (e.g. "500ms", "10m") of an
+// environment variable, or def when it is unset or invalid.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		slog.Warn("Invalid environment variable, using default", "key", key, "value", v, "default", def.String())
+		return def
 	}
-	r.Run(":" + port)
+	return d
 }
 
 func formatDatabaseURL(url string) string {
@@ -87,321 +546,4242 @@ func formatDatabaseURL(url string) string {
 		// Remove mysql:// prefix
 		url = strings.TrimPrefix(url, "mysql://")
 
-		// Split into user:pass and host:port/db
-		parts := strings.Split(url, "@")
-		if len(parts) != 2 {
+		// Split into user:pass and host:port/db?params; the password may
+		// itself contain '@'
+		at := strings.LastIndex(url, "@")
+		if at < 0 {
 			return url
 		}
+		userPass := url[:at]
+		hostDB, params, _ := strings.Cut(url[at+1:], "?")
+		host, dbName, _ := strings.Cut(hostDB, "/")
 
-		userPass := parts[0]
-		hostDB := parts[1]
+		if params != "" {
+			params += "&"
+		}
+		params += "charset=utf8mb4&parseTime=True&loc=Local"
 
 		// Format: user:pass@tcp(host:port)/db?params
-		return fmt.Sprintf("%s@tcp(%s)?charset=utf8mb4&parseTime=True&loc=Local", userPass, hostDB)
+		return fmt.Sprintf("%s@tcp(%s)/%s?%s", userPass, host, dbName, params)
 	}
 	return url
 }
 
-func initDB() {
-	dsn := os.Getenv("DATABASE_URL")
-	if dsn == "" {
-		// Try POSTGRES_URL as fallback
-		dsn = os.Getenv("POSTGRES_URL")
+// openDialector picks the GORM driver from the DSN scheme. DSNs without a
+// scheme are treated as PostgreSQL key/value connection strings.
+func openDialector(dsn string) (gorm.Dialector, error) {
+	scheme, _, hasScheme := strings.Cut(dsn, "://")
+	if hasScheme && !validScheme(scheme) {
+		// A key/value DSN with "://" inside a value, e.g. a password
+		hasScheme = false
+	}
+	switch {
+	case !hasScheme, scheme == "postgres", scheme == "postgresql":
+		// For PostgreSQL, the DSN can be used as is
+		return postgres.Open(dsn), nil
+	case scheme == "mysql":
+		return mysql.Open(formatDatabaseURL(dsn)), nil
+	default:
+		return nil, fmt.Errorf("DATABASE_URL scheme '%s' is not supported; use postgres:// or mysql://", scheme)
+	}
+}
+
+// validScheme reports whether s has the syntax of a URL scheme: a letter
+// followed by letters, digits, '+', '-', or '.'.
+func validScheme(s string) bool {
+	for i, r := range s {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case i > 0 && ('0' <= r && r <= '9' || r == '+' || r == '-' || r == '.'):
+		default:
+			return false
+		}
 	}
+	return s != ""
+}
+
+func initDB() {
+	dsn := cfg.DatabaseURL
 	if dsn == "" {
-		log.Fatal("DATABASE_URL or POSTGRES_URL environment variable is required")
+		slog.Error("DATABASE_URL, POSTGRES_URL, or database_url in the config file is required")
+		os.Exit(1)
 	}
 
-	// For PostgreSQL, the DSN can be used as is
-	dsn = formatDatabaseURL(dsn)
+	dialector, err := openDialector(dsn)
+	if err != nil {
+		slog.Error("Invalid database URL", "error", err)
+		os.Exit(1)
+	}
 
-	var err error
-	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	db, err = gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
-		log.Fatal("Failed to connect to database:", err)
+		slog.Error("Failed to connect to database", "error", err)
+		os.Exit(1)
 	}
 
 	// Auto migrate
-	db.AutoMigrate(&Country{})
+	db.AutoMigrate(&Country{}, &CountryCurrency{}, &CountrySnapshot{}, &RefreshLog{}, &AuditLog{})
+	// Rows stored before updated_at existed last changed when refreshed
+	if err := db.Exec("UPDATE countries SET updated_at = last_refreshed_at WHERE updated_at IS NULL").Error; err != nil {
+		slog.Error("Failed to backfill updated_at", "error", err)
+		os.Exit(1)
+	}
+	if err := migrateNameIndex(); err != nil {
+		slog.Error("Failed to add case-insensitive country name index", "error", err)
+		os.Exit(1)
+	}
+	if err := loadHasData(); err != nil {
+		slog.Error("Failed to check for existing data", "error", err)
+		os.Exit(1)
+	}
 }
 
-func refreshCountries(c *gin.Context) {
-	// Fetch countries
-	countries, err := fetchCountries()
-	if err != nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{
-			"error":   "External data source unavailable",
-			"details": "Could not fetch data from restcountries.com",
-		})
-		return
+// loadHasData sets hasData if a refresh succeeded before this process
+// started. Deployments older than the refresh log have countries but no
+// log entries, so stored countries count too.
+func loadHasData() error {
+	var refreshes, countries int64
+	if err := db.Model(&RefreshLog{}).Where("success = ?", true).Count(&refreshes).Error; err != nil {
+		return err
+	}
+	if err := db.Unscoped().Model(&Country{}).Count(&countries).Error; err != nil {
+		return err
+	}
+	hasData.Store(refreshes > 0 || countries > 0)
+	return nil
+}
+
+// migrateNameIndex adds a unique index on LOWER(name) so names differing
+// only in case can't both be stored. MySQL's default collations already
+// compare case-insensitively, so only Postgres needs it. Existing duplicates
+// are reported rather than merged.
+func migrateNameIndex() error {
+	if isMySQL() {
+		return nil
 	}
 
-	// Fetch exchange rates
-	rates, err := fetchExchangeRates()
+	var dupes []string
+	err := db.Unscoped().Model(&Country{}).
+		Group("LOWER(name)").
+		Having("COUNT(*) > 1").
+		Pluck("LOWER(name)", &dupes).Error
 	if err != nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{
-			"error":   "External data source unavailable",
-			"details": "Could not fetch data from open.er-api.com",
-		})
-		return
+		return err
 	}
+	if len(dupes) > 0 {
+		return fmt.Errorf("remove countries whose names differ only in case first: %s", strings.Join(dupes, ", "))
+	}
+	return db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_countries_name_lower ON countries (LOWER(name))").Error
+}
 
-	now := time.Now()
+// isMySQL reports whether the database is MySQL, for the few queries whose
+// syntax differs from PostgreSQL.
+func isMySQL() bool {
+	return db.Dialector.Name() == "mysql"
+}
 
-	// Process and save countries
-	for _, rc := range countries {
-		country := Country{
-			Name:            rc.Name,
-			Capital:         rc.Capital,
-			Region:          rc.Region,
-			Population:      rc.Population,
-			FlagURL:         rc.Flag,
-			LastRefreshedAt: now,
-		}
-
-		// Handle currency
-		if len(rc.Currencies) > 0 && rc.Currencies[0] != nil {
-			if code, ok := rc.Currencies[0]["code"]; ok && code != "" {
-				country.CurrencyCode = &code
-			}
-		}
+// likeOperator returns the case-insensitive LIKE operator. MySQL's default
+// collations already compare case-insensitively.
+func likeOperator() string {
+	if isMySQL() {
+		return "LIKE"
+	}
+	return "ILIKE"
+}
 
-		// Get exchange rate if currency code exists
-		if country.CurrencyCode != nil {
-			if rate, ok := rates[*country.CurrencyCode]; ok {
-				country.ExchangeRate = &rate
+// randomFunc returns the SQL function for a random number per row.
+func randomFunc() string {
+	if isMySQL() {
+		return "RAND()"
+	}
+	return "RANDOM()"
+}
 
-				// Calculate estimated GDP
-				multiplier := rand.Float64()*(2000-1000) + 1000
-				gdp := float64(country.Population) * multiplier / rate
-				country.EstimatedGDP = &gdp
-			} else {
-				// Rate not found, exchange_rate null (already nil), estimated_gdp null
-			}
-		} else {
-			// No currency, set estimated_gdp to 0
-			zero := 0.0
-			country.EstimatedGDP = &zero
-		}
-
-		// Update or create
-		var existing Country
-		result := db.Where("LOWER(name) = LOWER(?)", country.Name).First(&existing)
-		if result.Error == nil {
-			// Update existing
-			country.ID = existing.ID
-			db.Save(&country)
-		} else {
-			// Create new
-			db.Create(&country)
-		}
+// lastRefreshTime returns the latest last_refreshed_at, or the zero time
+// when no countries are stored.
+func lastRefreshTime(tx *gorm.DB) (time.Time, error) {
+	var last sql.NullTime
+	err := tx.Model(&Country{}).Select("MAX(last_refreshed_at)").Scan(&last).Error
+	return last.Time, err
+}
+
+// queryDB returns db bound to ctx with the DB_QUERY_TIMEOUT deadline, so a
+// hung database fails the request instead of blocking it.
+func queryDB(ctx context.Context) (*gorm.DB, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, envDuration("DB_QUERY_TIMEOUT", 5*time.Second))
+	return db.WithContext(ctx), cancel
+}
+
+// respondDBError aborts with 504 when a query ran out of time and 503 for
+// any other database failure.
+func respondDBError(c *gin.Context, err error) {
+	logger(c.Request.Context()).Error("Database query failed", "error", err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		respondError(c, http.StatusGatewayTimeout, ErrCodeDatabaseTimeout, "Database timed out", "")
+		return
 	}
+	respondError(c, http.StatusServiceUnavailable, ErrCodeDatabaseUnavailable, "Database unavailable", "")
+}
 
-	// Generate summary image
-	if err := generateSummaryImage(); err != nil {
-		log.Printf("Failed to generate image: %v", err)
+// respondLookupError responds 404 with message for a missing row and
+// defers to respondDBError otherwise.
+func respondLookupError(c *gin.Context, err error, message string) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		respondError(c, http.StatusNotFound, ErrCodeCountryNotFound, message, "")
+		return
 	}
+	respondDBError(c, err)
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message":           "Countries refreshed successfully",
-		"last_refreshed_at": now,
-	})
+// respondError aborts the request with a structured APIError body.
+func respondError(c *gin.Context, status int, code, message, details string) {
+	c.AbortWithStatusJSON(status, gin.H{"error": APIError{
+		Code:    code,
+		Message: message,
+		Details: details,
+	}})
 }
 
-func getCountries(c *gin.Context) {
-	var countries []Country
-	query := db
+func refreshCountries(c *gin.Context) {
+	// force=true bypasses the upstream cache
+	force, _ := strconv.ParseBool(c.Query("force"))
 
-	// Filters
-	if region := c.Query("region"); region != "" {
-		query = query.Where("region = ?", region)
-	}
-	if currency := c.Query("currency"); currency != "" {
-		query = query.Where("currency_code = ?", currency)
-	}
-
-	// Sorting
-	sort := c.Query("sort")
-	switch sort {
-	case "gdp_desc":
-		query = query.Order("estimated_gdp DESC NULLS LAST")
-	case "gdp_asc":
-		query = query.Order("estimated_gdp ASC NULLS FIRST")
-	case "population_desc":
-		query = query.Order("population DESC")
-	case "population_asc":
-		query = query.Order("population ASC")
-	default:
-		query = query.Order("name ASC")
+	// An optional body narrows the refresh to a region or named countries
+	var scope RefreshScope
+	if !decodeJSON(c, &scope, true) {
+		return
+	}
+	if err := scope.validate(); err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid request body", err.Error())
+		return
 	}
 
-	query.Find(&countries)
-	c.JSON(http.StatusOK, countries)
-}
+	// dryRun=true reports what would change without writing anything
+	if dryRun, _ := strconv.ParseBool(c.Query("dryRun")); dryRun {
+		diff, err := diffRefresh(c.Request.Context(), force, scope)
+		if err != nil {
+			respondRefreshError(c, err)
+			return
+		}
+		status := http.StatusOK
+		if len(diff.FailedSources) > 0 {
+			status = http.StatusPartialContent
+		}
+		c.JSON(status, diff)
+		return
+	}
 
-func getCountry(c *gin.Context) {
-	name := c.Param("name")
-	var country Country
+	if key := c.GetHeader("Idempotency-Key"); key != "" {
+		idempotentRefresh(c, key, force, scope)
+		return
+	}
 
-	if err := db.Where("LOWER(name) = LOWER(?)", name).First(&country).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Country not found"})
+	status, response, err := refreshResponse(c.Request.Context(), force, scope)
+	if err != nil {
+		respondRefreshError(c, err)
 		return
 	}
+	c.JSON(status, response)
+}
 
-	c.JSON(http.StatusOK, country)
+// refreshResponse runs a refresh and builds the refresh endpoint's status
+// and body: 206 when an upstream source failed but the refresh went ahead.
+func refreshResponse(ctx context.Context, force bool, scope RefreshScope) (int, gin.H, error) {
+	result, err := runRefresh(ctx, force, scope)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	response := gin.H{
+		"message":           "Countries refreshed successfully",
+		"countries":         result.Countries,
+		"created":           result.Created,
+		"updated":           result.Updated,
+		"skipped_count":     len(result.Skipped),
+		"skipped":           result.Skipped,
+		"last_refreshed_at": result.LastRefreshedAt,
+		"warnings":          result.Warnings,
+	}
+	if len(scope.Names) > 0 {
+		response["not_found"] = result.NotFound
+	}
+	if len(result.Removed) > 0 {
+		response["removed"] = result.Removed
+	}
+	if len(result.FailedSources) > 0 {
+		response["message"] = "Countries refreshed with partial data"
+		response["failed_sources"] = result.FailedSources
+		return http.StatusPartialContent, response, nil
+	}
+	return http.StatusOK, response, nil
 }
 
-func deleteCountry(c *gin.Context) {
-	name := c.Param("name")
-	var country Country
+// idempotentRefresh runs a refresh at most once per Idempotency-Key within
+// IDEMPOTENCY_TTL. A repeat of the key waits for the refresh it started and
+// gets the same response, marked with Idempotent-Replayed.
+func idempotentRefresh(c *gin.Context, key string, force bool, scope RefreshScope) {
+	if len(key) > 255 {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid header", "Idempotency-Key must be at most 255 characters")
+		return
+	}
+	// Keys are per API key so two clients can't collide
+	key = c.GetString(apiKeyIDKey) + ":" + key
+	fingerprint := fmt.Sprintf("force=%t region=%q names=%q", force, scope.Region, scope.Names)
 
-	if err := db.Where("LOWER(name) = LOWER(?)", name).First(&country).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Country not found"})
+	entry, owner := idempotentRefreshes.claim(key, fingerprint)
+	if !owner {
+		if entry.fingerprint != fingerprint {
+			respondError(c, http.StatusUnprocessableEntity, ErrCodeIdempotencyKeyReused, "Idempotency key reused",
+				"The key was already used for a refresh with different parameters")
+			return
+		}
+		select {
+		case <-entry.done:
+		case <-c.Request.Context().Done():
+			return
+		}
+		c.Header("Idempotent-Replayed", "true")
+		if entry.err != nil {
+			respondRefreshError(c, entry.err)
+			return
+		}
+		c.JSON(entry.status, entry.response)
 		return
 	}
 
-	db.Delete(&country)
-	c.JSON(http.StatusOK, gin.H{"message": "Country deleted successfully"})
+	// The default error releases the key if the refresh panics
+	var status int
+	var response gin.H
+	err := errors.New("refresh panicked")
+	defer func() {
+		idempotentRefreshes.finish(key, entry, status, response, err, envDuration("IDEMPOTENCY_TTL", time.Hour))
+	}()
+
+	status, response, err = refreshResponse(c.Request.Context(), force, scope)
+	if err != nil {
+		respondRefreshError(c, err)
+		return
+	}
+	c.JSON(status, response)
 }
 
-func getStatus(c *gin.Context) {
-	var count int64
-	var lastRefresh time.Time
+// idempotentRefreshes holds refresh outcomes by Idempotency-Key. It is in
+// memory only, so keys don't survive a restart or span instances.
+var idempotentRefreshes = &idempotencyStore{entries: make(map[string]*idempotencyEntry)}
 
-	db.Model(&Country{}).Count(&count)
-	db.Model(&Country{}).Select("COALESCE(MAX(last_refreshed_at), '0001-01-01T00:00:00Z')").Scan(&lastRefresh)
+type idempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"total_countries":   count,
-		"last_refreshed_at": lastRefresh,
-	})
+// idempotencyEntry is one key's refresh. status, response, and err are set
+// before done is closed; expires is zero while the refresh runs.
+type idempotencyEntry struct {
+	fingerprint string
+	done        chan struct{}
+	status      int
+	response    gin.H
+	err         error
+	expires     time.Time
 }
 
-func getCountryImage(c *gin.Context) {
-	if _, err := os.Stat("cache/summary.png"); os.IsNotExist(err) {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Summary image not found"})
-		return
-	}
+// claim returns the entry for key, creating it when there is none. The
+// caller that created it must run the refresh and call finish.
+func (s *idempotencyStore) claim(key, fingerprint string) (*idempotencyEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	c.File("cache/summary.png")
+	now := time.Now()
+	for k, e := range s.entries {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			delete(s.entries, k)
+		}
+	}
+	if e, ok := s.entries[key]; ok {
+		return e, false
+	}
+	e := &idempotencyEntry{fingerprint: fingerprint, done: make(chan struct{})}
+	s.entries[key] = e
+	return e, true
 }
 
-func fetchCountries() ([]RestCountry, error) {
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Get("https://restcountries.com/v2/all?fields=name,capital,region,population,flag,currencies")
+// finish records a refresh's outcome and wakes the requests waiting on it.
+// A success is kept for ttl; a failure is forgotten, so a retry with the
+// same key runs a new refresh.
+func (s *idempotencyStore) finish(key string, e *idempotencyEntry, status int, response gin.H, err error, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.status, e.response, e.err = status, response, err
 	if err != nil {
-		return nil, err
+		delete(s.entries, key)
+	} else {
+		e.expires = time.Now().Add(ttl)
 	}
-	defer resp.Body.Close()
+	close(e.done)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API returned status %d", resp.StatusCode)
-	}
+// RefreshScope limits a refresh to one region or a list of country names.
+// The zero value refreshes everything.
+type RefreshScope struct {
+	Region string   `json:"region"`
+	Names  []string `json:"names"`
+}
 
-	var countries []RestCountry
-	if err := json.NewDecoder(resp.Body).Decode(&countries); err != nil {
-		return nil, err
+// validate rejects scopes that set both fields, blank names, or an unknown
+// region, canonicalizing the region's spelling.
+func (s *RefreshScope) validate() error {
+	if s.Region != "" && len(s.Names) > 0 {
+		return errors.New("specify either region or names, not both")
+	}
+	for _, name := range s.Names {
+		if strings.TrimSpace(name) == "" {
+			return errors.New("names must not be blank")
+		}
+	}
+	if s.Region != "" {
+		region, ok := canonicalRegion(s.Region)
+		if !ok {
+			return fmt.Errorf("region must be one of: %s", strings.Join(knownRegions, ", "))
+		}
+		s.Region = region
 	}
+	return nil
+}
 
-	return countries, nil
+// canonicalRegion matches region case-insensitively against knownRegions.
+func canonicalRegion(region string) (string, bool) {
+	i := slices.IndexFunc(knownRegions, func(r string) bool { return strings.EqualFold(r, region) })
+	if i < 0 {
+		return "", false
+	}
+	return knownRegions[i], true
 }
 
-func fetchExchangeRates() (map[string]float64, error) {
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Get("https://open.er-api.com/v6/latest/USD")
-	if err != nil {
-		return nil, err
+// filter returns the countries in scope, plus any requested names that
+// weren't found upstream.
+func (s RefreshScope) filter(countries []RestCountry) ([]RestCountry, []string) {
+	if s.Region == "" && len(s.Names) == 0 {
+		return countries, nil
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API returned status %d", resp.StatusCode)
+	wanted := map[string]bool{}
+	for _, name := range s.Names {
+		wanted[strings.ToLower(strings.TrimSpace(name))] = true
 	}
 
-	var rates ExchangeRates
-	if err := json.NewDecoder(resp.Body).Decode(&rates); err != nil {
-		return nil, err
+	var scoped []RestCountry
+	found := map[string]bool{}
+	for _, rc := range countries {
+		key := strings.ToLower(rc.Name)
+		if (s.Region != "" && rc.Region == s.Region) || wanted[key] {
+			scoped = append(scoped, rc)
+			found[key] = true
+		}
 	}
 
-	return rates.Rates, nil
+	notFound := []string{}
+	for _, name := range s.Names {
+		if !found[strings.ToLower(strings.TrimSpace(name))] {
+			notFound = append(notFound, name)
+		}
+	}
+	return scoped, notFound
 }
 
-func generateSummaryImage() error {
-	// Get total countries
-	var totalCountries int64
-	db.Model(&Country{}).Count(&totalCountries)
+// refreshMu ensures only one refresh runs at a time
+var refreshMu sync.Mutex
+
+// hasData is set once any refresh has succeeded; until then read endpoints
+// answer 503 rather than an empty result
+var hasData atomic.Bool
 
-	// Get top 5 by GDP
-	var topCountries []Country
-	db.Where("estimated_gdp IS NOT NULL").
-		Order("estimated_gdp DESC").
-		Limit(5).
-		Find(&topCountries)
+var errRefreshInProgress = &refreshError{http.StatusConflict, ErrCodeRefreshInProgress,
+	"Refresh already in progress", "", errors.New("refresh already in progress")}
 
-	// Get last refresh time
-	var lastRefresh time.Time
-	db.Model(&Country{}).Select("COALESCE(MAX(last_refreshed_at), '0001-01-01T00:00:00Z')").Scan(&lastRefresh)
+// RefreshResult summarizes a successful refresh
+type RefreshResult struct {
+	Countries       int              `json:"countries"`
+	Created         int              `json:"created"`
+	Updated         int              `json:"updated"`
+	LastRefreshedAt time.Time        `json:"last_refreshed_at"`
+	NotFound        []string         `json:"not_found,omitempty"`
+	Skipped         []SkippedCountry `json:"skipped"`
+	Warnings        []string         `json:"warnings"`
+	// Upstream sources that failed without failing the refresh
+	FailedSources []string `json:"failed_sources,omitempty"`
+	// Stored countries soft-deleted because of EXCLUDE_COUNTRIES
+	Removed []string `json:"removed,omitempty"`
+}
 
-	// Create image
-	img := image.NewRGBA(image.Rect(0, 0, 800, 600))
+// SkippedCountry is an upstream record that failed validation and was not
+// stored. Index is its position in the upstream list.
+type SkippedCountry struct {
+	Index  int    `json:"index"`
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
 
-	// Fill background
-	for y := 0; y < 600; y++ {
-		for x := 0; x < 800; x++ {
-			img.Set(x, y, color.RGBA{240, 248, 255, 255})
+// validateCountries drops upstream records with a blank name, a negative
+// population, or a name already seen (ignoring case), so a change in the
+// upstream response shape can't store zeroed rows.
+func validateCountries(countries []RestCountry) ([]RestCountry, []SkippedCountry) {
+	valid := make([]RestCountry, 0, len(countries))
+	skipped := []SkippedCountry{}
+	seen := make(map[string]bool, len(countries))
+	for i, rc := range countries {
+		reason := ""
+		switch key := strings.ToLower(rc.Name); {
+		case key == "":
+			reason = "missing name"
+		case rc.Population < 0:
+			reason = "negative population"
+		case seen[key]:
+			reason = "duplicate name"
+		default:
+			seen[key] = true
+			valid = append(valid, rc)
+			continue
 		}
+		skipped = append(skipped, SkippedCountry{Index: i, Name: rc.Name, Reason: reason})
 	}
+	return valid, skipped
+}
 
-	// Load font
-	font, err := truetype.Parse(goregular.TTF)
-	if err != nil {
-		return err
-	}
+// renamedCountry is an upstream name changed by normalizeNames
+type renamedCountry struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
 
-	c := freetype.NewContext()
-	c.SetDPI(72)
-	c.SetFont(font)
-	c.SetFontSize(24)
-	c.SetClip(img.Bounds())
-	c.SetDst(img)
-	c.SetSrc(image.NewUniform(color.RGBA{0, 0, 0, 255}))
-
-	// Draw title
-	pt := freetype.Pt(50, 80)
-	c.DrawString("Country Data Summary", pt)
-
-	// Draw total countries
-	c.SetFontSize(18)
-	pt = freetype.Pt(50, 140)
-	c.DrawString(fmt.Sprintf("Total Countries: %d", totalCountries), pt)
-
-	// Draw top 5 countries
-	pt = freetype.Pt(50, 200)
-	c.DrawString("Top 5 Countries by Estimated GDP:", pt)
-
-	c.SetFontSize(14)
-	y := 240
-	for i, country := range topCountries {
-		pt = freetype.Pt(70, y)
-		gdp := "N/A"
-		if country.EstimatedGDP != nil {
-			gdp = fmt.Sprintf("$%.2f", *country.EstimatedGDP)
+// normalizeNames trims upstream names, collapses inner runs of whitespace,
+// and applies Unicode NFC, so variants of one name compare equal before
+// validation and storage. It returns a copy along with the names it changed.
+func normalizeNames(countries []RestCountry) ([]RestCountry, []renamedCountry) {
+	normalized := slices.Clone(countries)
+	var renamed []renamedCountry
+	for i, rc := range normalized {
+		if name := normalizeName(rc.Name); name != rc.Name {
+			renamed = append(renamed, renamedCountry{From: rc.Name, To: name})
+			normalized[i].Name = name
 		}
-		c.DrawString(fmt.Sprintf("%d. %s - %s", i+1, country.Name, gdp), pt)
-		y += 40
 	}
+	return normalized, renamed
+}
 
-	// Draw timestamp
-	c.SetFontSize(16)
-	pt = freetype.Pt(50, 500)
-	c.DrawString(fmt.Sprintf("Last Refreshed: %s", lastRefresh.Format(time.RFC3339)), pt)
+// normalizeName is the normalization normalizeNames applies to one name.
+func normalizeName(name string) string {
+	return norm.NFC.String(strings.Join(strings.Fields(name), " "))
+}
 
-	// Save image
-	file, err := os.Create("cache/summary.png")
-	if err != nil {
-		return err
+// excludedNames returns the EXCLUDE_COUNTRIES names normalized like
+// upstream names and lowercased, for case-insensitive exact matching.
+func excludedNames() []string {
+	names := make([]string, 0, len(cfg.ExcludeCountries))
+	for _, name := range cfg.ExcludeCountries {
+		if name = strings.ToLower(normalizeName(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// excludeCountries drops upstream records named in EXCLUDE_COUNTRIES and
+// returns the names it dropped.
+func excludeCountries(countries []RestCountry) ([]RestCountry, []string) {
+	excluded := excludedNames()
+	if len(excluded) == 0 {
+		return countries, nil
+	}
+	kept := make([]RestCountry, 0, len(countries))
+	var dropped []string
+	for _, rc := range countries {
+		if slices.Contains(excluded, strings.ToLower(rc.Name)) {
+			dropped = append(dropped, rc.Name)
+			continue
+		}
+		kept = append(kept, rc)
+	}
+	return kept, dropped
+}
+
+// removeExcluded soft-deletes stored countries named in EXCLUDE_COUNTRIES,
+// recording each in the audit log, and returns their names.
+func removeExcluded(tx *gorm.DB) ([]string, error) {
+	excluded := excludedNames()
+	if len(excluded) == 0 {
+		return nil, nil
+	}
+	var matched []Country
+	if err := tx.Select("id", "name").Where("LOWER(name) IN ?", excluded).Order("name").Find(&matched).Error; err != nil {
+		return nil, err
+	}
+	if len(matched) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]uint, len(matched))
+	names := make([]string, len(matched))
+	logs := make([]AuditLog, len(matched))
+	for i, country := range matched {
+		ids[i], names[i] = country.ID, country.Name
+		logs[i] = AuditLog{Action: "exclude", CountryName: country.Name}
+	}
+	if err := tx.Delete(&Country{}, ids).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Create(&logs).Error; err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// refreshError is a failed refresh along with the error response it maps to
+type refreshError struct {
+	status  int
+	code    string
+	message string
+	details string
+	err     error
+}
+
+func (e *refreshError) Error() string {
+	if e.details == "" {
+		return e.err.Error()
+	}
+	return e.details + ": " + e.err.Error()
+}
+func (e *refreshError) Unwrap() error { return e.err }
+
+// respondRefreshError writes the response a refreshError maps to; any other
+// error came from the database.
+func respondRefreshError(c *gin.Context, err error) {
+	var refreshErr *refreshError
+	if errors.As(err, &refreshErr) {
+		respondError(c, refreshErr.status, refreshErr.code, refreshErr.message, refreshErr.details)
+		return
+	}
+	respondDBError(c, err)
+}
+
+// runRefresh fetches upstream data, upserts every country in scope, and
+// regenerates the summary image. It is shared by the refresh endpoint and
+// the scheduler.
+func runRefresh(ctx context.Context, force bool, scope RefreshScope) (result *RefreshResult, err error) {
+	// Never queue behind a running refresh; the deferred unlock also runs
+	// if the refresh panics
+	if !refreshMu.TryLock() {
+		return nil, errRefreshInProgress
+	}
+	defer refreshMu.Unlock()
+	defer func() { recordRefresh(err) }()
+	defer func() {
+		if err == nil {
+			hasData.Store(true)
+		}
+		// Runs after the refresh log is saved, which changes /status even
+		// when the refresh failed
+		statusCache.invalidate()
+	}()
+
+	log := logger(ctx)
+
+	entry := &RefreshLog{StartedAt: time.Now()}
+	defer func() { saveRefreshLog(ctx, entry, result, err) }()
+	defer func() { refreshProgress.finish(result, err) }()
+
+	countries, rates, failedSources, err := fetchUpstream(ctx, force, entry, refreshProgress)
+	if err != nil {
+		return nil, err
+	}
+	countries, renamed := normalizeNames(countries)
+	if len(renamed) > 0 {
+		log.Info("Normalized upstream country names", "count", len(renamed), "renamed", renamed)
+	}
+	countries, skipped := validateCountries(countries)
+	if len(skipped) > 0 {
+		log.Warn("Skipped invalid upstream countries", "count", len(skipped), "skipped", skipped)
+	}
+	countries, excluded := excludeCountries(countries)
+	if len(excluded) > 0 {
+		log.Info("Skipped excluded upstream countries", "count", len(excluded), "excluded", excluded)
+	}
+	countries, notFound := scope.filter(countries)
+
+	now := time.Now()
+
+	// Process and save countries in a single transaction so a failure
+	// leaves the previous data intact
+	txCtx, cancel := context.WithTimeout(ctx, envDuration("REFRESH_TIMEOUT", 2*time.Minute))
+	defer cancel()
+	var zeroPopulation, removed []string
+	var created, updated int
+	err = db.WithContext(txCtx).Transaction(func(tx *gorm.DB) error {
+		zeroPopulation, created, updated = nil, 0, 0
+		removed, err = removeExcluded(tx)
+		if err != nil {
+			return err
+		}
+		overrides, err := loadOverrides(tx)
+		if err != nil {
+			return err
+		}
+		// Stored names by lowercased name, so a casing change upstream
+		// keeps the existing name and its history
+		var names []string
+		if err := tx.Unscoped().Model(&Country{}).Pluck("name", &names).Error; err != nil {
+			return err
+		}
+		storedNames := make(map[string]string, len(names))
+		for _, name := range names {
+			storedNames[strings.ToLower(name)] = name
+		}
+
+		// Build every row up front so saveCountries can write them in batches
+		rows := make([]refreshRow, len(countries))
+		for i, rc := range countries {
+			country, currencies := buildCountry(rc, rates, overrides, now)
+			if name, ok := storedNames[strings.ToLower(country.Name)]; ok {
+				country.Name = name
+				updated++
+			} else {
+				created++
+			}
+			if country.Population == 0 {
+				zeroPopulation = append(zeroPopulation, country.Name)
+			}
+			rows[i] = refreshRow{country, currencies}
+		}
+		return saveCountries(tx, rows, now)
+	})
+	if err != nil {
+		log.Error("Failed to save countries", "error", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, &refreshError{http.StatusGatewayTimeout, ErrCodeDatabaseTimeout,
+				"Database timed out", "Could not save countries", err}
+		}
+		return nil, &refreshError{http.StatusInternalServerError, ErrCodeInternal,
+			"Internal server error", "Could not save countries", err}
+	}
+
+	if len(removed) > 0 {
+		log.Info("Removed excluded countries", "count", len(removed), "removed", removed)
+	}
+	if len(zeroPopulation) > 0 {
+		log.Warn("Countries arrived with zero or missing population", "count", len(zeroPopulation), "countries", zeroPopulation)
+	}
+
+	// A failed image doesn't fail the refresh, since the data is saved
+	warnings := []string{}
+	if slices.Contains(failedSources, "exchange_rates") {
+		warnings = append(warnings, "Exchange rates could not be fetched; countries were saved without exchange rates or GDP estimates until the next refresh")
+	}
+	imageErr := generateSummaryImage(ctx, defaultSummaryOptions, cacheFile(summaryImageFile))
+	summaryImageFailure.set(imageErr)
+	// Every cached variant is stale now; drop them so they don't pile up
+	evictSummaryVariants(0)
+	if imageErr != nil {
+		log.Error("Failed to generate image", "error", imageErr)
+		warnings = append(warnings, "Summary image was not generated; /countries/image returns 503 until the next successful refresh")
+	}
+	refreshProgress.publish("image_generated", gin.H{"generated": imageErr == nil})
+
+	return &RefreshResult{
+		Countries:       len(countries),
+		Created:         created,
+		Updated:         updated,
+		LastRefreshedAt: now,
+		NotFound:        notFound,
+		Skipped:         skipped,
+		Warnings:        warnings,
+		FailedSources:   failedSources,
+		Removed:         removed,
+	}, nil
+}
+
+// refreshRow is one country a refresh writes, with its currencies
+type refreshRow struct {
+	country    Country
+	currencies []CountryCurrency
+}
+
+// refreshBatchSize is how many countries each batch of refresh writes
+// covers
+const refreshBatchSize = 100
+
+// saveCountries writes rows in tx, refreshBatchSize countries at a time,
+// so the statements per refresh don't grow with the country count while
+// the refresh stays one all-or-nothing transaction.
+func saveCountries(tx *gorm.DB, rows []refreshRow, now time.Time) error {
+	for start := 0; start < len(rows); start += refreshBatchSize {
+		end := min(start+refreshBatchSize, len(rows))
+		if err := saveCountryBatch(tx, rows[start:end], now); err != nil {
+			return err
+		}
+		refreshProgress.upserted(end, len(rows))
+	}
+	return nil
+}
+
+// saveCountryBatch upserts a batch of countries, replaces their currencies,
+// and records a history snapshot for each.
+func saveCountryBatch(tx *gorm.DB, rows []refreshRow, now time.Time) error {
+	countries := make([]Country, len(rows))
+	names := make([]string, len(rows))
+	for i, row := range rows {
+		countries[i] = row.country
+		names[i] = row.country.Name
+	}
+
+	// Upsert keyed on the unique name index
+	if err := tx.Clauses(upsertCountryClause).Create(&countries).Error; err != nil {
+		return err
+	}
+	// MySQL cannot return the ids of rows updated by an upsert, so look
+	// them up on both drivers
+	var stored []struct {
+		ID   uint
+		Name string
+	}
+	if err := tx.Unscoped().Model(&Country{}).Select("id, name").Where("name IN ?", names).Scan(&stored).Error; err != nil {
+		return err
+	}
+	ids := make(map[string]uint, len(stored))
+	for _, s := range stored {
+		ids[strings.ToLower(s.Name)] = s.ID
+	}
+
+	// Replace currencies
+	countryIDs := make([]uint, 0, len(stored))
+	currencies := []CountryCurrency{}
+	for _, row := range rows {
+		id, ok := ids[strings.ToLower(row.country.Name)]
+		if !ok {
+			return fmt.Errorf("upserted country %q not found", row.country.Name)
+		}
+		countryIDs = append(countryIDs, id)
+		for _, cur := range row.currencies {
+			cur.CountryID = id
+			currencies = append(currencies, cur)
+		}
+	}
+	if err := tx.Where("country_id IN ?", countryIDs).Delete(&CountryCurrency{}).Error; err != nil {
+		return err
+	}
+	if len(currencies) > 0 {
+		if err := tx.Create(&currencies).Error; err != nil {
+			return err
+		}
+	}
+
+	// Record history
+	snapshots := make([]CountrySnapshot, len(rows))
+	for i, row := range rows {
+		snapshots[i] = CountrySnapshot{
+			CountryName:  row.country.Name,
+			Population:   row.country.Population,
+			ExchangeRate: row.country.ExchangeRate,
+			EstimatedGDP: row.country.EstimatedGDP,
+			CapturedAt:   now,
+		}
+	}
+	return tx.Create(&snapshots).Error
+}
+
+// fetchUpstream fetches countries and exchange rates through the upstream
+// caches, mapping failures to a refreshError. Failed rates don't fail the
+// fetch: the rates come back empty and "exchange_rates" is listed in the
+// failed sources. Each source's timing is recorded on entry and its
+// completion published to progress.
+func fetchUpstream(ctx context.Context, force bool, entry *RefreshLog, progress *progressHub) ([]RestCountry, ExchangeRates, []string, error) {
+	log := logger(ctx)
+
+	// Fetch countries
+	start := time.Now()
+	countries, err := countriesCache.get(ctx, force, fetchCountries)
+	entry.CountriesFetchMS, entry.CountriesFetchOK = fetchTiming(start, err)
+	if errors.Is(err, errTooFewCountries) {
+		log.Error("Upstream returned too few countries", "error", err)
+		return nil, ExchangeRates{}, nil, &refreshError{http.StatusBadGateway, ErrCodeUpstreamUnavailable,
+			"External data source returned too few countries", "Existing data was left unchanged", err}
+	}
+	if err != nil {
+		log.Error("Failed to fetch countries", "error", err)
+		return nil, ExchangeRates{}, nil, &refreshError{http.StatusServiceUnavailable, ErrCodeUpstreamUnavailable,
+			"External data source unavailable", "Could not fetch data from restcountries.com: " + describeUpstreamError(err), err}
+	}
+	progress.publish("fetched_countries", gin.H{"countries": len(countries)})
+
+	// Fetch exchange rates
+	start = time.Now()
+	rates, err := ratesCache.get(ctx, force, fetchExchangeRates)
+	entry.RatesFetchMS, entry.RatesFetchOK = fetchTiming(start, err)
+	if err != nil {
+		log.Error("Failed to fetch exchange rates, continuing without them", "error", err)
+		return countries, ExchangeRates{}, []string{"exchange_rates"}, nil
+	}
+	progress.publish("fetched_rates", gin.H{"rates": len(rates.Rates)})
+	return countries, rates, nil, nil
+}
+
+func fetchTiming(start time.Time, err error) (*int64, *bool) {
+	ms := time.Since(start).Milliseconds()
+	ok := err == nil
+	return &ms, &ok
+}
+
+// saveRefreshLog stores the outcome of a refresh. It runs even if the
+// request was cancelled, and a failure is only logged.
+func saveRefreshLog(ctx context.Context, entry *RefreshLog, result *RefreshResult, err error) {
+	entry.DurationMS = time.Since(entry.StartedAt).Milliseconds()
+	entry.Success = err == nil
+	if err != nil {
+		msg := err.Error()
+		entry.Error = &msg
+	}
+	if result != nil {
+		entry.Countries = result.Countries
+	}
+
+	tx, cancel := queryDB(context.WithoutCancel(ctx))
+	defer cancel()
+	if err := tx.Create(entry).Error; err != nil {
+		logger(ctx).Error("Failed to save refresh log", "error", err)
+	}
+}
+
+// loadOverrides returns the manually overridden countries, keyed by
+// lowercased name.
+func loadOverrides(tx *gorm.DB) (map[string]Country, error) {
+	var overridden []Country
+	if err := tx.Unscoped().Where("manual_override = ?", true).Find(&overridden).Error; err != nil {
+		return nil, err
+	}
+	overrides := make(map[string]Country, len(overridden))
+	for _, o := range overridden {
+		overrides[strings.ToLower(o.Name)] = o
+	}
+	return overrides, nil
+}
+
+// buildCountry turns an upstream record into the row a refresh stores,
+// along with its currencies.
+func buildCountry(rc RestCountry, rates ExchangeRates, overrides map[string]Country, now time.Time) (Country, []CountryCurrency) {
+	country := Country{
+		Name:            rc.Name,
+		Capital:         rc.Capital,
+		Region:          rc.Region,
+		Population:      rc.Population,
+		FlagURL:         rc.Flag,
+		LastRefreshedAt: now,
+		UpdatedAt:       now,
+		Alpha2Code:      rc.Alpha2Code,
+		Alpha3Code:      rc.Alpha3Code,
+		Borders:         rc.Borders,
+	}
+	if country.Borders == nil {
+		country.Borders = []string{}
+	}
+	country.OverriddenFields = []string{}
+	if len(rc.LatLng) == 2 {
+		lat, lng := rc.LatLng[0], rc.LatLng[1]
+		country.Latitude, country.Longitude = &lat, &lng
+	}
+	if stored, ok := overrides[strings.ToLower(rc.Name)]; ok {
+		applyOverrides(&country, stored)
+	}
+
+	// Handle currencies, the first one being the primary
+	var currencies []CountryCurrency
+	seen := map[string]bool{}
+	for _, cur := range rc.Currencies {
+		// Codes are stored uppercase, as the rates feed and filters use them
+		code := strings.ToUpper(strings.TrimSpace(cur["code"]))
+		if code == "" || seen[code] {
+			continue
+		}
+		seen[code] = true
+
+		currency := CountryCurrency{Code: code}
+		if symbol := cur["symbol"]; symbol != "" {
+			currency.Symbol = &symbol
+		}
+		if rate, ok := rates.Rates[code]; ok {
+			currency.ExchangeRate = &rate
+		}
+		currencies = append(currencies, currency)
+	}
+	if len(currencies) > 0 {
+		country.CurrencyCode = &currencies[0].Code
+		country.CurrencySymbol = currencies[0].Symbol
+	}
+	if slices.ContainsFunc(currencies, func(c CountryCurrency) bool { return c.ExchangeRate != nil }) {
+		country.RatesAsOf = rates.asOf()
+		country.RatesBase = cfg.BaseCurrency
+	}
+
+	// Missing or zero population is stored as 0 with a null estimated_gdp
+	// rather than a computed 0
+	if country.Population <= 0 {
+		country.Population = 0
+	}
+
+	// Get exchange rate if currency code exists
+	if country.CurrencyCode != nil {
+		if rate, ok := rates.Rates[*country.CurrencyCode]; ok {
+			country.ExchangeRate = &rate
+
+			// Calculate estimated GDP
+			if country.Population > 0 {
+				if gdp, ok := estimateGDP(country.Population, rate, gdpSeed(country.Name)); ok {
+					country.EstimatedGDP = &gdp
+				} else {
+					slog.Warn("Skipped GDP estimate for an unusable exchange rate", "country", country.Name,
+						"currency", *country.CurrencyCode, "rate", rate)
+				}
+			}
+		} else {
+			// Rate not found, exchange_rate null (already nil), estimated_gdp null
+		}
+	} else if country.Population > 0 {
+		// No currency, set estimated_gdp to 0
+		zero := 0.0
+		country.EstimatedGDP = &zero
+	}
+
+	return country, currencies
+}
+
+// RefreshDiff describes what a refresh would change without applying it
+type RefreshDiff struct {
+	Countries int             `json:"countries"`
+	New       []string        `json:"new"`
+	Changed   []CountryChange `json:"changed"`
+	// Stored countries upstream no longer lists; a refresh leaves them as-is
+	MissingUpstream []string         `json:"missing_upstream"`
+	NotFound        []string         `json:"not_found,omitempty"`
+	Skipped         []SkippedCountry `json:"skipped"`
+	FailedSources   []string         `json:"failed_sources,omitempty"`
+	// Stored countries the refresh would remove for EXCLUDE_COUNTRIES
+	Removed []string `json:"removed,omitempty"`
+}
+
+// CountryChange is a stored country whose population or exchange rate
+// would change
+type CountryChange struct {
+	Name            string   `json:"name"`
+	OldPopulation   int64    `json:"old_population"`
+	NewPopulation   int64    `json:"new_population"`
+	OldExchangeRate *float64 `json:"old_exchange_rate"`
+	NewExchangeRate *float64 `json:"new_exchange_rate"`
+}
+
+// MarshalJSON rounds both exchange rates to 4 decimals, like Country.
+func (ch CountryChange) MarshalJSON() ([]byte, error) {
+	type change CountryChange
+	return json.Marshal(struct {
+		change
+		OldExchangeRate *float64 `json:"old_exchange_rate"`
+		NewExchangeRate *float64 `json:"new_exchange_rate"`
+	}{change(ch), roundPtr(ch.OldExchangeRate, 4), roundPtr(ch.NewExchangeRate, 4)})
+}
+
+// diffRefresh fetches upstream data and compares what a refresh would store
+// with the database. Nothing is written and the image is left alone.
+// Missing-upstream countries are only reported for unscoped refreshes.
+func diffRefresh(ctx context.Context, force bool, scope RefreshScope) (*RefreshDiff, error) {
+	countries, rates, failedSources, err := fetchUpstream(ctx, force, &RefreshLog{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	countries, _ = normalizeNames(countries)
+	countries, skipped := validateCountries(countries)
+	countries, _ = excludeCountries(countries)
+	countries, notFound := scope.filter(countries)
+
+	tx, cancel := queryDB(ctx)
+	defer cancel()
+	overrides, err := loadOverrides(tx)
+	if err != nil {
+		return nil, err
+	}
+	var stored []Country
+	// Soft-deleted rows stay hidden after a refresh, so they are neither new
+	// nor changed
+	if err := tx.Unscoped().Order("name").Find(&stored).Error; err != nil {
+		return nil, err
+	}
+	byName := make(map[string]Country, len(stored))
+	for _, s := range stored {
+		byName[strings.ToLower(s.Name)] = s
+	}
+
+	diff := &RefreshDiff{
+		Countries:       len(countries),
+		New:             []string{},
+		Changed:         []CountryChange{},
+		MissingUpstream: []string{},
+		NotFound:        notFound,
+		Skipped:         skipped,
+		FailedSources:   failedSources,
+	}
+	upstream := make(map[string]bool, len(countries))
+	now := time.Now()
+	for _, rc := range countries {
+		country, _ := buildCountry(rc, rates, overrides, now)
+		key := strings.ToLower(country.Name)
+		upstream[key] = true
+
+		old, ok := byName[key]
+		if !ok {
+			diff.New = append(diff.New, country.Name)
+			continue
+		}
+		if old.DeletedAt.Valid {
+			continue
+		}
+		if old.Population != country.Population || !equalFloatPtr(old.ExchangeRate, country.ExchangeRate) {
+			diff.Changed = append(diff.Changed, CountryChange{
+				Name:            old.Name,
+				OldPopulation:   old.Population,
+				NewPopulation:   country.Population,
+				OldExchangeRate: old.ExchangeRate,
+				NewExchangeRate: country.ExchangeRate,
+			})
+		}
+	}
+	excluded := excludedNames()
+	for _, s := range stored {
+		if !s.DeletedAt.Valid && slices.Contains(excluded, strings.ToLower(s.Name)) {
+			diff.Removed = append(diff.Removed, s.Name)
+		}
+	}
+	if scope.Region == "" && len(scope.Names) == 0 {
+		for _, s := range stored {
+			if !s.DeletedAt.Valid && !upstream[strings.ToLower(s.Name)] && !slices.Contains(diff.Removed, s.Name) {
+				diff.MissingUpstream = append(diff.MissingUpstream, s.Name)
+			}
+		}
+	}
+	slices.Sort(diff.New)
+	slices.SortFunc(diff.Changed, func(a, b CountryChange) int { return cmp.Compare(a.Name, b.Name) })
+	return diff, nil
+}
+
+func equalFloatPtr(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// scheduleRefresh runs a refresh every interval until ctx is done. Failures
+// and panics are logged and never stop the server.
+func scheduleRefresh(ctx context.Context, interval time.Duration) {
+	slog.Info("Scheduled refresh enabled", "interval", interval.String())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			backgroundRefresh(ctx, "Scheduled")
+		}
+	}
+}
+
+// backgroundRefresh runs one full refresh and logs its outcome, prefixed
+// with kind. Failures and panics never stop the server.
+func backgroundRefresh(ctx context.Context, kind string) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error(kind+" refresh panicked", "panic", fmt.Sprint(r))
+		}
+	}()
+
+	result, err := runRefresh(ctx, true, RefreshScope{})
+	if errors.Is(err, errRefreshInProgress) {
+		slog.Info(kind + " refresh skipped, refresh already in progress")
+		return
+	}
+	if err != nil {
+		slog.Error(kind+" refresh failed", "error", err)
+		return
+	}
+	slog.Info(kind+" refresh succeeded", "countries", result.Countries,
+		"created", result.Created, "updated", result.Updated, "skipped", len(result.Skipped), "warnings", result.Warnings)
+}
+
+// applyOverrides copies stored's manually overridden fields onto country so
+// a refresh doesn't clobber them.
+func applyOverrides(country *Country, stored Country) {
+	for _, field := range stored.OverriddenFields {
+		switch field {
+		case "capital":
+			country.Capital = stored.Capital
+		case "region":
+			country.Region = stored.Region
+		case "population":
+			country.Population = stored.Population
+		case "flag_url":
+			country.FlagURL = stored.FlagURL
+		}
+	}
+}
+
+// estimateGDP returns population × multiplier ÷ rate, where the multiplier
+// in the configured GDP multiplier range is drawn from an RNG seeded with
+// seed, so the same inputs always produce the same estimate. It reports
+// false rather than returning NaN or Inf for an invalid rate.
+func estimateGDP(population int64, rate float64, seed int64) (float64, bool) {
+	if !validRate(rate) {
+		return 0, false
+	}
+	lo, hi := cfg.GDPMultiplierMin, cfg.GDPMultiplierMax
+	multiplier := rand.New(rand.NewSource(seed)).Float64()*(hi-lo) + lo
+	gdp := float64(population) * multiplier / rate
+	return gdp, !math.IsInf(gdp, 0)
+}
+
+// validRate reports whether an exchange rate is usable: finite and
+// positive.
+func validRate(rate float64) bool {
+	return rate > 0 && !math.IsInf(rate, 0)
+}
+
+// gdpSeed derives a stable RNG seed from a country name.
+func gdpSeed(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(name)))
+	return int64(h.Sum64())
+}
+
+// upsertCountryClause updates every refreshed column when a country with
+// the same name, ignoring case, already exists. The target matches the LOWER(name) index on Postgres;
+// MySQL ignores it and uses its case-insensitive unique name index.
+var upsertCountryClause = clause.OnConflict{
+	Columns: []clause.Column{{Name: "LOWER(name)", Raw: true}},
+	DoUpdates: clause.AssignmentColumns([]string{
+		"capital", "region", "population", "currency_code", "currency_symbol",
+		"exchange_rate", "rates_as_of", "rates_base", "estimated_gdp", "flag_url", "last_refreshed_at", "updated_at",
+		"alpha2_code", "alpha3_code", "borders", "latitude", "longitude",
+	}),
+}
+
+func getCountries(c *gin.Context) {
+	switch c.Query("format") {
+	case "csv":
+		exportCountriesCSV(c)
+		return
+	case "jsonl":
+		exportCountriesJSONL(c)
+		return
+	}
+
+	// Pagination
+	limit, offset, err := parsePagination(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter", err.Error())
+		return
+	}
+
+	order, err := countryOrder(c.Query("sort"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter", err.Error())
+		return
+	}
+
+	fields, err := parseFields(c.Query("fields"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter", err.Error())
+		return
+	}
+
+	var withRank bool
+	if v := c.Query("withRank"); v != "" {
+		if withRank, err = strconv.ParseBool(v); err != nil {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter", "withRank must be true or false")
+			return
+		}
+	}
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	countries := []Country{}
+	base := tx.Model(&Country{})
+	if includeDeleted, _ := strconv.ParseBool(c.Query("includeDeleted")); includeDeleted {
+		// Deleted rows are for admins, even though listing is public
+		if !knownAPIKey(requestAPIKey(c), cfg.APIKeys) {
+			respondError(c, http.StatusForbidden, ErrCodeForbidden, "API key required", "includeDeleted requires a valid API key")
+			return
+		}
+		base = base.Unscoped()
+	}
+	query, err := filterCountries(c, tx, base)
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+
+	// Conditional GET
+	etag, err := countriesETag(tx, c.Request.URL.RawQuery)
+	if err != nil {
+		respondDBError(c, err)
+		return
+	}
+	c.Header("ETag", etag)
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	// Total after filters, before limit/offset
+	query = query.Session(&gorm.Session{})
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		respondDBError(c, err)
+		return
+	}
+
+	// Pages are already capped at maxPageLimit, so MAX_RESULTS only applies
+	// here when it is set, and then only below that cap; its default is
+	// for the exports
+	if maxRows := envInt("MAX_RESULTS", 0); maxRows > 0 && limit > maxRows {
+		limit = maxRows
+	}
+	// Flag any page that stops short of the full result, whatever cut it
+	if total > int64(offset+limit) {
+		c.Header("X-Result-Truncated", "true")
+	}
+
+	if err := query.Scopes(withCurrencies).Order(order).Limit(limit).Offset(offset).Find(&countries).Error; err != nil {
+		respondDBError(c, err)
+		return
+	}
+	data := selectFields(countries, fields)
+	if withRank {
+		data = rankCountries(countries, offset, fields)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+		"data":   data,
+	})
+}
+
+// RankedCountry is a country with its 1-based position in the sorted,
+// filtered listing
+type RankedCountry struct {
+	Country
+	Rank int `json:"rank"`
+}
+
+// MarshalJSON keeps rank, which Country's promoted MarshalJSON would
+// otherwise drop.
+func (r RankedCountry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		roundedCountry
+		Rank int `json:"rank"`
+	}{r.Country.rounded(), r.Rank})
+}
+
+// rankCountries numbers a page of countries starting after offset, trimmed
+// to fields like selectFields but always keeping rank.
+func rankCountries(countries []Country, offset int, fields []string) any {
+	if len(fields) == 0 {
+		ranked := make([]RankedCountry, len(countries))
+		for i, country := range countries {
+			ranked[i] = RankedCountry{country, offset + i + 1}
+		}
+		return ranked
+	}
+	picked := make([]map[string]json.RawMessage, len(countries))
+	for i, country := range countries {
+		picked[i] = pickFields(country, fields)
+		picked[i]["rank"] = json.RawMessage(strconv.Itoa(offset + i + 1))
+	}
+	return picked
+}
+
+// countryFields are the JSON keys of Country, in declaration order
+var countryFields = func() []string {
+	var names []string
+	t := reflect.TypeFor[Country]()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}()
+
+// parseFields parses a comma-separated fields param, checking each name
+// against countryFields. An empty param selects every field.
+func parseFields(v string) ([]string, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var fields []string
+	for _, f := range strings.Split(v, ",") {
+		f = strings.TrimSpace(f)
+		if !slices.Contains(countryFields, f) {
+			return nil, fmt.Errorf("unknown field %q; fields must be among: %s", f, strings.Join(countryFields, ", "))
+		}
+		if !slices.Contains(fields, f) {
+			fields = append(fields, f)
+		}
+	}
+	return fields, nil
+}
+
+// selectFields returns countries as-is when fields is empty, otherwise each
+// trimmed to just those JSON keys.
+func selectFields(countries []Country, fields []string) any {
+	if len(fields) == 0 {
+		return countries
+	}
+	picked := make([]map[string]json.RawMessage, len(countries))
+	for i, country := range countries {
+		picked[i] = pickFields(country, fields)
+	}
+	return picked
+}
+
+// pickFields encodes country and keeps only the given keys, so the output
+// matches the full object's encoding exactly.
+func pickFields(country Country, fields []string) map[string]json.RawMessage {
+	data, _ := json.Marshal(country)
+	var all map[string]json.RawMessage
+	json.Unmarshal(data, &all)
+
+	picked := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		picked[f] = all[f]
+	}
+	return picked
+}
+
+// exportQuery builds the query shared by the CSV and JSON Lines exports:
+// every country matching the same filters and sort as getCountries, capped
+// at MAX_RESULTS. It responds and returns false for an invalid request.
+func exportQuery(c *gin.Context) (*gorm.DB, bool) {
+	order, err := countryOrder(c.Query("sort"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter", err.Error())
+		return nil, false
+	}
+	// Region lookups get the query timeout; the export itself streams for
+	// as long as the client keeps reading
+	lookup, cancel := queryDB(c.Request.Context())
+	defer cancel()
+	query, err := filterCountries(c, lookup, db.WithContext(c.Request.Context()).Model(&Country{}))
+	if err != nil {
+		respondFilterError(c, err)
+		return nil, false
+	}
+
+	// Cap the export so an unfiltered request can't stream the whole table
+	if maxRows := envInt("MAX_RESULTS", 500); maxRows > 0 {
+		var total int64
+		if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+			respondDBError(c, err)
+			return nil, false
+		}
+		if total > int64(maxRows) {
+			c.Header("X-Result-Truncated", "true")
+			query = query.Limit(maxRows)
+		}
+	}
+	return query.Order(order), true
+}
+
+// exportCountriesCSV streams the countries selected by exportQuery as a CSV
+// attachment.
+func exportCountriesCSV(c *gin.Context) {
+	query, ok := exportQuery(c)
+	if !ok {
+		return
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		respondDBError(c, err)
+		return
+	}
+	defer rows.Close()
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="countries.csv"`)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"name", "capital", "region", "population", "currency_code", "exchange_rate", "estimated_gdp"})
+	for rows.Next() {
+		var country Country
+		if err := db.ScanRows(rows, &country); err != nil {
+			logger(c.Request.Context()).Error("Failed to export countries", "error", err)
+			break
+		}
+		w.Write([]string{
+			country.Name,
+			country.Capital,
+			country.Region,
+			strconv.FormatInt(country.Population, 10),
+			formatOptionalString(country.CurrencyCode),
+			formatOptionalFloat(country.ExchangeRate),
+			formatOptionalFloat(country.EstimatedGDP),
+		})
+	}
+	w.Flush()
+}
+
+// jsonlBatchSize is how many countries the JSON Lines export loads
+// currencies for, writes, and flushes at a time
+const jsonlBatchSize = 100
+
+// exportCountriesJSONL streams the countries selected by exportQuery as
+// JSON Lines, one country object per line, flushing after every batch so
+// clients can process them as they arrive. fields trims each object as in
+// getCountries.
+func exportCountriesJSONL(c *gin.Context) {
+	fields, err := parseFields(c.Query("fields"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter", err.Error())
+		return
+	}
+	query, ok := exportQuery(c)
+	if !ok {
+		return
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		respondDBError(c, err)
+		return
+	}
+	defer rows.Close()
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+
+	// Errors after the first line can only end the stream early
+	log := logger(c.Request.Context())
+	enc := json.NewEncoder(c.Writer)
+	batch := make([]Country, 0, jsonlBatchSize)
+	writeBatch := func() bool {
+		if err := attachCurrencies(c.Request.Context(), batch); err != nil {
+			log.Error("Failed to export countries", "error", err)
+			return false
+		}
+		for _, country := range batch {
+			var v any = country
+			if len(fields) > 0 {
+				v = pickFields(country, fields)
+			}
+			if err := enc.Encode(v); err != nil {
+				return false
+			}
+		}
+		c.Writer.Flush()
+		batch = batch[:0]
+		return true
+	}
+
+	for rows.Next() {
+		var country Country
+		if err := db.ScanRows(rows, &country); err != nil {
+			log.Error("Failed to export countries", "error", err)
+			return
+		}
+		// ScanRows skips hooks, so derive the per-capita GDP here
+		country.AfterFind(nil)
+		batch = append(batch, country)
+		if len(batch) == jsonlBatchSize && !writeBatch() {
+			return
+		}
+	}
+	if len(batch) > 0 {
+		writeBatch()
+	}
+}
+
+// attachCurrencies loads the currencies of countries in one query, in the
+// same order as withCurrencies.
+func attachCurrencies(ctx context.Context, countries []Country) error {
+	ids := make([]uint, len(countries))
+	for i, country := range countries {
+		ids[i] = country.ID
+	}
+	tx, cancel := queryDB(ctx)
+	defer cancel()
+
+	var currencies []CountryCurrency
+	if err := tx.Where("country_id IN ?", ids).Order("id ASC").Find(&currencies).Error; err != nil {
+		return err
+	}
+	byCountry := make(map[uint][]CountryCurrency, len(countries))
+	for _, currency := range currencies {
+		byCountry[currency.CountryID] = append(byCountry[currency.CountryID], currency)
+	}
+	for i := range countries {
+		// Encode a country without currencies as [] rather than null
+		countries[i].Currencies = []CountryCurrency{}
+		if currencies, ok := byCountry[countries[i].ID]; ok {
+			countries[i].Currencies = currencies
+		}
+	}
+	return nil
+}
+
+// formatOptionalString returns "" for nil.
+func formatOptionalString(v *string) string {
+	if v == nil {
+		return ""
+	}
+	return *v
+}
+
+// formatOptionalFloat returns "" for nil.
+func formatOptionalFloat(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
+
+// filterCountries applies the region, currency, search, startsWith,
+// population, and hasRate filters from the query string. Invalid parameters are reported as an
+// invalidParamError; tx is used to look up the valid regions.
+func filterCountries(c *gin.Context, tx, query *gorm.DB) (*gorm.DB, error) {
+	if region := c.Query("region"); region != "" {
+		canonical, valid, err := resolveRegion(tx, region)
+		if err != nil {
+			return nil, err
+		}
+		if canonical == "" {
+			return nil, invalidParamError(fmt.Sprintf("region must be one of: %s", strings.Join(valid, ", ")))
+		}
+		query = query.Where("region = ?", canonical)
+	}
+	if currency := strings.ToUpper(strings.TrimSpace(c.Query("currency"))); currency != "" {
+		// Match any of the country's currencies
+		query = query.Where("id IN (?)", tx.Model(&CountryCurrency{}).Select("country_id").Where("code = ?", currency))
+	}
+	if search := c.Query("search"); search != "" {
+		term := "%" + escapeLike(search) + "%"
+		like := likeOperator()
+		query = query.Where(fmt.Sprintf("name %[1]s ? OR capital %[1]s ?", like), term, term)
+	}
+	if prefix := strings.TrimSpace(c.Query("startsWith")); prefix != "" {
+		query = query.Where("name "+likeOperator()+" ?", escapeLike(prefix)+"%")
+	}
+	// A min above max simply matches nothing
+	if v := c.Query("minPopulation"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, invalidParamError("minPopulation must be an integer")
+		}
+		query = query.Where("population >= ?", n)
+	}
+	if v := c.Query("maxPopulation"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, invalidParamError("maxPopulation must be an integer")
+		}
+		query = query.Where("population <= ?", n)
+	}
+	if v := c.Query("hasRate"); v != "" {
+		hasRate, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, invalidParamError("hasRate must be true or false")
+		}
+		if hasRate {
+			query = query.Where("exchange_rate IS NOT NULL")
+		} else {
+			query = query.Where("exchange_rate IS NULL")
+		}
+	}
+	return query, nil
+}
+
+// invalidParamError is a query parameter that failed validation
+type invalidParamError string
+
+func (e invalidParamError) Error() string { return string(e) }
+
+// respondFilterError responds 400 for an invalid filter and defers to
+// respondDBError when the filter lookup itself failed.
+func respondFilterError(c *gin.Context, err error) {
+	var invalid invalidParamError
+	if errors.As(err, &invalid) {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter", err.Error())
+		return
+	}
+	respondDBError(c, err)
+}
+
+// knownRegions are the regions reported by restcountries
+var knownRegions = []string{"Africa", "Americas", "Antarctic", "Asia", "Europe", "Oceania"}
+
+// resolveRegion matches region case-insensitively against the known regions
+// and any others present in the database. It returns the canonical spelling,
+// or "" along with the valid regions when there is no match.
+func resolveRegion(tx *gorm.DB, region string) (string, []string, error) {
+	var present []string
+	if err := tx.Model(&Country{}).Where("region <> ''").Distinct().Pluck("region", &present).Error; err != nil {
+		return "", nil, err
+	}
+
+	valid := append([]string{}, knownRegions...)
+	for _, r := range present {
+		if !slices.ContainsFunc(valid, func(v string) bool { return strings.EqualFold(v, r) }) {
+			valid = append(valid, r)
+		}
+	}
+	slices.Sort(valid)
+
+	for _, v := range valid {
+		if strings.EqualFold(v, region) {
+			return v, valid, nil
+		}
+	}
+	return "", valid, nil
+}
+
+// countrySorts maps each supported sort param to its ORDER BY clause
+// Every order ends on the unique name, so pages never overlap and ranks
+// are stable
+var countrySorts = map[string]string{
+	"name_asc":            "name ASC",
+	"name_desc":           "name DESC",
+	"capital_asc":         "capital ASC, name ASC",
+	"capital_desc":        "capital DESC, name ASC",
+	"gdp_desc":            "estimated_gdp DESC NULLS LAST, name ASC",
+	"gdp_asc":             "estimated_gdp ASC NULLS FIRST, name ASC",
+	"population_desc":     "population DESC, name ASC",
+	"population_asc":      "population ASC, name ASC",
+	"gdp_per_capita_desc": "estimated_gdp / NULLIF(population, 0) DESC NULLS LAST, name ASC",
+	// Grouped by region, names sorted within each group
+	"region": "region ASC, name ASC",
+}
+
+// countryOrder returns the ORDER BY clause for a sort param, defaulting to
+// name ascending when it is empty.
+func countryOrder(sort string) (string, error) {
+	if sort == "" {
+		sort = "name_asc"
+	}
+	order, ok := countrySorts[sort]
+	if !ok {
+		return "", fmt.Errorf("sort must be one of: %s", strings.Join(slices.Sorted(maps.Keys(countrySorts)), ", "))
+	}
+	// MySQL has no NULLS FIRST/LAST, but its defaults (first when ascending,
+	// last when descending) match every clause above
+	if isMySQL() {
+		order = strings.NewReplacer(" NULLS LAST", "", " NULLS FIRST", "").Replace(order)
+	}
+	return order, nil
+}
+
+// countriesETag identifies the current state of the countries table for a
+// given query string. Any refresh, PATCH, or restore moves the latest
+// updated_at and any delete changes the row count.
+func countriesETag(tx *gorm.DB, rawQuery string) (string, error) {
+	var state struct {
+		Count      int64
+		LastUpdate sql.NullTime
+	}
+	err := tx.Model(&Country{}).
+		Select("COUNT(*) AS count, MAX(updated_at) AS last_update").
+		Scan(&state).Error
+	if err != nil {
+		return "", err
+	}
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d|%d|%s", state.Count, state.LastUpdate.Time.UnixNano(), rawQuery)
+	return fmt.Sprintf(`"%x"`, h.Sum64()), nil
+}
+
+// etagMatches reports whether an If-None-Match header matches etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// notModifiedSince reports whether an If-Modified-Since header is at or
+// after modified. Unparseable dates are ignored.
+func notModifiedSince(ifModifiedSince string, modified time.Time) bool {
+	if ifModifiedSince == "" {
+		return false
+	}
+	since, err := http.ParseTime(ifModifiedSince)
+	return err == nil && !modified.After(since)
+}
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+)
+
+// parsePagination reads the limit and offset query params, applying the
+// default limit and clamping it to maxPageLimit.
+func parsePagination(c *gin.Context) (int, int, error) {
+	limit := defaultPageLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("limit must be a non-negative integer")
+		}
+		limit = n
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+
+	offset := 0
+	if v := c.Query("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+		offset = n
+	}
+
+	return limit, offset, nil
+}
+
+// byIdentifier matches a country by name (case-insensitive) or by its ISO
+// alpha-2 or alpha-3 code, preferring a name match.
+func byIdentifier(identifier string) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("LOWER(name) = LOWER(?) OR alpha2_code = UPPER(?) OR alpha3_code = UPPER(?)", identifier, identifier, identifier).
+			Order(clause.OrderBy{Expression: clause.Expr{SQL: "CASE WHEN LOWER(name) = LOWER(?) THEN 0 ELSE 1 END", Vars: []any{identifier}}})
+	}
+}
+
+// withCurrencies preloads a country's currencies in upstream order.
+func withCurrencies(tx *gorm.DB) *gorm.DB {
+	return tx.Preload("Currencies", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("id ASC")
+	})
+}
+
+// escapeLike escapes LIKE wildcards so user input is matched literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func getCountry(c *gin.Context) {
+	fields, err := parseFields(c.Query("fields"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter", err.Error())
+		return
+	}
+
+	name := c.Param("name")
+	var country Country
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	if err := tx.Scopes(withCurrencies, byIdentifier(name)).First(&country).Error; err != nil {
+		respondLookupError(c, err, "Country not found")
+		return
+	}
+
+	// Conditional GET, at the second precision of HTTP dates
+	modified := country.UpdatedAt.UTC().Truncate(time.Second)
+	c.Header("Last-Modified", modified.Format(http.TimeFormat))
+	if notModifiedSince(c.GetHeader("If-Modified-Since"), modified) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	if len(fields) > 0 {
+		c.JSON(http.StatusOK, pickFields(country, fields))
+		return
+	}
+	c.JSON(http.StatusOK, country)
+}
+
+// getRandomCountry returns one random country, optionally within ?region=.
+// The database picks the row, so nothing else is loaded.
+func getRandomCountry(c *gin.Context) {
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	query := tx.Scopes(withCurrencies)
+	if region := c.Query("region"); region != "" {
+		canonical, valid, err := resolveRegion(tx, region)
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+		if canonical == "" {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter",
+				fmt.Sprintf("region must be one of: %s", strings.Join(valid, ", ")))
+			return
+		}
+		query = query.Where("region = ?", canonical)
+	}
+
+	var country Country
+	if err := query.Order(randomFunc()).Take(&country).Error; err != nil {
+		respondLookupError(c, err, "No countries found")
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, country)
+}
+
+// topMetrics maps the metric param of GET /countries/top to the expression
+// it ranks by
+var topMetrics = map[string]string{
+	"gdp":            "estimated_gdp",
+	"population":     "population",
+	"gdp_per_capita": "estimated_gdp / NULLIF(population, 0)",
+}
+
+const (
+	defaultTopLimit = 5
+	maxTopLimit     = 50
+)
+
+// rankedBy orders by expr, highest first, and keeps the first limit rows.
+// Rows where expr is null are left out.
+func rankedBy(expr string, limit int) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where(expr + " IS NOT NULL").Order(expr + " DESC").Limit(limit)
+	}
+}
+
+// getTopCountries ranks countries by ?metric= (default gdp), optionally
+// within ?region=; the summary image shows the same ranking by GDP.
+func getTopCountries(c *gin.Context) {
+	metric := c.DefaultQuery("metric", "gdp")
+	expr, ok := topMetrics[metric]
+	if !ok {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter",
+			fmt.Sprintf("metric must be one of: %s", strings.Join(slices.Sorted(maps.Keys(topMetrics)), ", ")))
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultTopLimit)))
+	if err != nil || limit < 1 || limit > maxTopLimit {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter",
+			fmt.Sprintf("limit must be an integer between 1 and %d", maxTopLimit))
+		return
+	}
+	fields, err := parseFields(c.Query("fields"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter", err.Error())
+		return
+	}
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	query := tx.Scopes(withCurrencies, rankedBy(expr, limit))
+	if region := c.Query("region"); region != "" {
+		canonical, valid, err := resolveRegion(tx, region)
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+		if canonical == "" {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter",
+				fmt.Sprintf("region must be one of: %s", strings.Join(valid, ", ")))
+			return
+		}
+		query = query.Where("region = ?", canonical)
+	}
+
+	countries := []Country{}
+	if err := query.Find(&countries).Error; err != nil {
+		respondDBError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"metric": metric, "data": selectFields(countries, fields)})
+}
+
+func getCountryHistory(c *gin.Context) {
+	limit, offset, err := parsePagination(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter", err.Error())
+		return
+	}
+
+	direction := strings.ToUpper(c.DefaultQuery("order", "asc"))
+	if direction != "ASC" && direction != "DESC" {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter", "order must be asc or desc")
+		return
+	}
+
+	name := c.Param("name")
+	var country Country
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	if err := tx.Where("LOWER(name) = LOWER(?)", name).First(&country).Error; err != nil {
+		respondLookupError(c, err, "Country not found")
+		return
+	}
+
+	query, err := historyQuery(c, tx, country)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter", err.Error())
+		return
+	}
+
+	// Total within the bounds, before limit/offset
+	query = query.Session(&gorm.Session{})
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		respondDBError(c, err)
+		return
+	}
+
+	snapshots := []CountrySnapshot{}
+	// id breaks ties between snapshots of the same refresh, so pages never overlap
+	order := fmt.Sprintf("captured_at %[1]s, id %[1]s", direction)
+	if err := query.Order(order).Limit(limit).Offset(offset).Find(&snapshots).Error; err != nil {
+		respondDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"country":   country.Name,
+		"total":     total,
+		"limit":     limit,
+		"offset":    offset,
+		"snapshots": snapshots,
+	})
+}
+
+// getCountryNeighbors resolves a country's border codes to stored
+// countries. Codes with no stored country are listed in unknown.
+func getCountryNeighbors(c *gin.Context) {
+	name := c.Param("name")
+	var country Country
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	if err := tx.Where("LOWER(name) = LOWER(?)", name).First(&country).Error; err != nil {
+		respondLookupError(c, err, "Country not found")
+		return
+	}
+
+	neighbors := []Country{}
+	if len(country.Borders) > 0 {
+		err := tx.Scopes(withCurrencies).Where("alpha3_code IN ?", country.Borders).Order("name ASC").Find(&neighbors).Error
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+	}
+
+	known := make(map[string]bool, len(neighbors))
+	for _, n := range neighbors {
+		known[n.Alpha3Code] = true
+	}
+	unknown := []string{}
+	for _, code := range country.Borders {
+		if !known[code] {
+			unknown = append(unknown, code)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"country":   country.Name,
+		"neighbors": neighbors,
+		"unknown":   unknown,
+	})
+}
+
+// getSimilarCountries returns countries in the same region whose population
+// is within 50% of the target's, closest population first.
+func getSimilarCountries(c *gin.Context) {
+	limit := 5
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 50 {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter",
+				"limit must be an integer between 1 and 50")
+			return
+		}
+		limit = n
+	}
+
+	name := c.Param("name")
+	var country Country
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	if err := tx.Where("LOWER(name) = LOWER(?)", name).First(&country).Error; err != nil {
+		respondLookupError(c, err, "Country not found")
+		return
+	}
+
+	population := float64(country.Population)
+	low, high := int64(math.Ceil(population*0.5)), int64(math.Floor(population*1.5))
+
+	similar := []Country{}
+	err := tx.Scopes(withCurrencies).
+		Where("region = ? AND id <> ? AND population BETWEEN ? AND ?", country.Region, country.ID, low, high).
+		Order(clause.OrderBy{Expression: clause.Expr{SQL: "ABS(population - ?), name", Vars: []any{country.Population}}}).
+		Limit(limit).
+		Find(&similar).Error
+	if err != nil {
+		respondDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"country": country.Name,
+		"data":    similar,
+	})
+}
+
+// historyQuery selects a country's snapshots within the optional from/to
+// query params.
+func historyQuery(c *gin.Context, tx *gorm.DB, country Country) (*gorm.DB, error) {
+	query := tx.Model(&CountrySnapshot{}).Where("country_name = ?", country.Name)
+	for _, bound := range []struct{ param, cond string }{
+		{"from", "captured_at >= ?"},
+		{"to", "captured_at <= ?"},
+	} {
+		v := c.Query(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := parseTimeParam(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be an RFC 3339 timestamp or YYYY-MM-DD date", bound.param)
+		}
+		query = query.Where(bound.cond, t)
+	}
+	return query, nil
+}
+
+// HistoryBucket averages the snapshots captured in one interval
+type HistoryBucket struct {
+	Bucket              time.Time `json:"bucket"`
+	AveragePopulation   float64   `json:"average_population"`
+	AverageExchangeRate *float64  `json:"average_exchange_rate"`
+	Snapshots           int64     `json:"snapshots"`
+}
+
+// MarshalJSON rounds average_exchange_rate to 4 decimals, like Country.
+func (b HistoryBucket) MarshalJSON() ([]byte, error) {
+	type bucket HistoryBucket
+	return json.Marshal(struct {
+		bucket
+		AverageExchangeRate *float64 `json:"average_exchange_rate"`
+	}{bucket(b), roundPtr(b.AverageExchangeRate, 4)})
+}
+
+// getCountryHistoryAggregate buckets a country's snapshots by day, week, or
+// month so trends can be drawn without every raw snapshot.
+func getCountryHistoryAggregate(c *gin.Context) {
+	interval := c.DefaultQuery("interval", "day")
+	bucket, err := truncateTime("captured_at", interval)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter", err.Error())
+		return
+	}
+
+	name := c.Param("name")
+	var country Country
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	if err := tx.Where("LOWER(name) = LOWER(?)", name).First(&country).Error; err != nil {
+		respondLookupError(c, err, "Country not found")
+		return
+	}
+
+	query, err := historyQuery(c, tx, country)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter", err.Error())
+		return
+	}
+
+	buckets := []HistoryBucket{}
+	err = query.
+		Select(bucket + " AS bucket, AVG(population) AS average_population, AVG(exchange_rate) AS average_exchange_rate, COUNT(*) AS snapshots").
+		Group("bucket").
+		Order("bucket ASC").
+		Scan(&buckets).Error
+	if err != nil {
+		respondDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"country":  country.Name,
+		"interval": interval,
+		"buckets":  buckets,
+	})
+}
+
+// truncateTime returns SQL truncating column to the start of its day, week
+// (Monday), or month for the active driver.
+func truncateTime(column, interval string) (string, error) {
+	if !slices.Contains([]string{"day", "week", "month"}, interval) {
+		return "", fmt.Errorf("interval must be one of: day, week, month")
+	}
+	if !isMySQL() {
+		return fmt.Sprintf("DATE_TRUNC('%s', %s)", interval, column), nil
+	}
+	switch interval {
+	case "week":
+		return fmt.Sprintf("DATE_SUB(DATE(%[1]s), INTERVAL WEEKDAY(%[1]s) DAY)", column), nil
+	case "month":
+		return fmt.Sprintf("CAST(DATE_FORMAT(%s, '%%Y-%%m-01') AS DATE)", column), nil
+	default:
+		return fmt.Sprintf("DATE(%s)", column), nil
+	}
+}
+
+// parseTimeParam accepts either an RFC 3339 timestamp or a YYYY-MM-DD date.
+func parseTimeParam(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, v)
+}
+
+func convertCurrency(c *gin.Context) {
+	name := c.Param("name")
+	var country Country
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	if err := tx.Scopes(byIdentifier(name)).First(&country).Error; err != nil {
+		respondLookupError(c, err, "Country not found")
+		return
+	}
+
+	amount, err := strconv.ParseFloat(c.Query("amount"), 64)
+	if err != nil || math.IsNaN(amount) || math.IsInf(amount, 0) {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter", "amount must be a number")
+		return
+	}
+
+	// Default to the country's own currency
+	to := strings.ToUpper(c.Query("to"))
+	if to == "" && country.CurrencyCode != nil {
+		to = *country.CurrencyCode
+	}
+	if to == "" {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter", "to currency is required")
+		return
+	}
+
+	rate, asOf, ok, err := lookupRate(tx, to)
+	if err != nil {
+		if errors.Is(err, errRateLookup) {
+			respondDBError(c, err)
+			return
+		}
+		respondError(c, http.StatusServiceUnavailable, ErrCodeUpstreamUnavailable,
+			"External data source unavailable", "Could not fetch data from open.er-api.com")
+		return
+	}
+	if !ok {
+		respondError(c, http.StatusNotFound, ErrCodeRateNotFound,
+			"Exchange rate not found", fmt.Sprintf("No exchange rate available for currency %s", to))
+		return
+	}
+
+	symbol, err := currencySymbol(tx, to)
+	if err != nil {
+		respondDBError(c, err)
+		return
+	}
+
+	// formatted prefixes the converted amount with the currency's symbol,
+	// falling back to its code
+	converted := amount * rate
+	if math.IsInf(converted, 0) {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter", "amount is too large to convert")
+		return
+	}
+	prefix := to + " "
+	if symbol != nil {
+		prefix = *symbol
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"country":     country.Name,
+		"amount":      amount,
+		"from":        cfg.BaseCurrency,
+		"to":          to,
+		"symbol":      symbol,
+		"rate":        roundTo(rate, 4),
+		"rates_as_of": asOf,
+		"converted":   converted,
+		"formatted":   fmt.Sprintf("%s%.2f", prefix, converted),
+	})
+}
+
+// currencySymbol returns the stored symbol for a currency code, or nil
+// when no stored country lists one.
+func currencySymbol(tx *gorm.DB, code string) (*string, error) {
+	var stored CountryCurrency
+	err := tx.Where("code = ? AND symbol IS NOT NULL", code).First(&stored).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return stored.Symbol, err
+}
+
+// lookupRate returns the base currency's exchange rate to a currency code
+// and when upstream last updated it, preferring the rate stored by the last
+// refresh and falling back to the exchange API. Stored rates of deleted
+// countries, or fetched against another base currency, are skipped.
+func lookupRate(tx *gorm.DB, code string) (float64, *time.Time, bool, error) {
+	var stored struct {
+		ExchangeRate float64
+		RatesAsOf    *time.Time
+	}
+	result := tx.Table("country_currencies").
+		Select("country_currencies.exchange_rate, countries.rates_as_of").
+		Joins("JOIN countries ON countries.id = country_currencies.country_id").
+		Where("country_currencies.code = ? AND country_currencies.exchange_rate > 0", code).
+		Where("countries.deleted_at IS NULL AND countries.rates_base = ?", cfg.BaseCurrency).
+		Limit(1).
+		Scan(&stored)
+	if result.Error != nil {
+		return 0, nil, false, fmt.Errorf("%w: %w", errRateLookup, result.Error)
+	}
+	if result.RowsAffected > 0 {
+		return stored.ExchangeRate, stored.RatesAsOf, true, nil
+	}
+
+	rates, err := ratesCache.get(tx.Statement.Context, false, fetchExchangeRates)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	rate, ok := rates.Rates[code]
+	return rate, rates.asOf(), ok, nil
+}
+
+// errRateLookup wraps database failures from lookupRate, as opposed to
+// exchange API failures
+var errRateLookup = errors.New("stored rate lookup failed")
+
+func compareCountries(c *gin.Context) {
+	// Collect distinct, non-empty names
+	var names []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(c.Query("names"), ",") {
+		name = strings.TrimSpace(name)
+		key := strings.ToLower(name)
+		if name == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		names = append(names, name)
+	}
+	if len(names) < 2 {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter", "At least two country names are required")
+		return
+	}
+
+	lowered := make([]string, len(names))
+	for i, name := range names {
+		lowered[i] = strings.ToLower(name)
+	}
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	var matches []Country
+	if err := tx.Scopes(withCurrencies).Where("LOWER(name) IN ?", lowered).Find(&matches).Error; err != nil {
+		respondDBError(c, err)
+		return
+	}
+
+	byName := make(map[string]Country, len(matches))
+	for _, country := range matches {
+		byName[strings.ToLower(country.Name)] = country
+	}
+
+	// Keep the order the names were requested in
+	countries := []Country{}
+	notFound := []string{}
+	for i, name := range names {
+		if country, ok := byName[lowered[i]]; ok {
+			countries = append(countries, country)
+		} else {
+			notFound = append(notFound, name)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"countries": countries,
+		"not_found": notFound,
+	})
+}
+
+// BatchRequest is the body of POST /countries/batch
+type BatchRequest struct {
+	Names []string `json:"names"`
+}
+
+// batchGetCountries looks up many countries by name, alpha-2, or alpha-3
+// code at once, resolving each like GET /countries/:name. Matches keep the
+// requested order, and a country requested twice is returned once.
+func batchGetCountries(c *gin.Context) {
+	var body BatchRequest
+	if !decodeJSON(c, &body, false) {
+		return
+	}
+
+	// Collect distinct identifiers
+	var identifiers []string
+	seen := map[string]bool{}
+	for _, name := range body.Names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid request body", "names must not be blank")
+			return
+		}
+		if key := strings.ToLower(name); !seen[key] {
+			seen[key] = true
+			identifiers = append(identifiers, name)
+		}
+	}
+	if maxNames := envInt("BATCH_MAX_NAMES", 100); len(identifiers) == 0 || len(identifiers) > maxNames {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid request body",
+			fmt.Sprintf("names must list between 1 and %d countries", maxNames))
+		return
+	}
+
+	lowered := make([]string, len(identifiers))
+	uppered := make([]string, len(identifiers))
+	for i, identifier := range identifiers {
+		lowered[i] = strings.ToLower(identifier)
+		uppered[i] = strings.ToUpper(identifier)
+	}
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	var matches []Country
+	err := tx.Scopes(withCurrencies).
+		Where("LOWER(name) IN ? OR alpha2_code IN ? OR alpha3_code IN ?", lowered, uppered, uppered).
+		Find(&matches).Error
+	if err != nil {
+		respondDBError(c, err)
+		return
+	}
+
+	byName := make(map[string]Country, len(matches))
+	byCode := make(map[string]Country, 2*len(matches))
+	for _, country := range matches {
+		byName[strings.ToLower(country.Name)] = country
+		for _, code := range []string{country.Alpha2Code, country.Alpha3Code} {
+			if code != "" {
+				byCode[code] = country
+			}
+		}
+	}
+
+	// Names win over codes, as in byIdentifier
+	countries := []Country{}
+	notFound := []string{}
+	returned := map[uint]bool{}
+	for i, identifier := range identifiers {
+		country, ok := byName[lowered[i]]
+		if !ok {
+			country, ok = byCode[uppered[i]]
+		}
+		switch {
+		case !ok:
+			notFound = append(notFound, identifier)
+		case !returned[country.ID]:
+			returned[country.ID] = true
+			countries = append(countries, country)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"countries": countries,
+		"not_found": notFound,
+	})
+}
+
+// NearbyCountry is a country with its distance from the queried point
+type NearbyCountry struct {
+	Country
+	DistanceKM float64 `json:"distance_km"`
+}
+
+// MarshalJSON keeps distance_km, which Country's promoted MarshalJSON would
+// otherwise drop.
+func (n NearbyCountry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		roundedCountry
+		DistanceKM float64 `json:"distance_km"`
+	}{n.Country.rounded(), n.DistanceKM})
+}
+
+// getNearbyCountries returns countries whose centroid lies within radius km
+// of lat/lng, nearest first. Distances are computed in Go, not SQL.
+func getNearbyCountries(c *gin.Context) {
+	var lat, lng, radius float64
+	for _, p := range []struct {
+		name     string
+		dst      *float64
+		min, max float64
+		def      string
+	}{
+		{"lat", &lat, -90, 90, ""},
+		{"lng", &lng, -180, 180, ""},
+		{"radius", &radius, 0, 40075, "1000"}, // up to Earth's circumference
+	} {
+		v := c.DefaultQuery(p.name, p.def)
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n < p.min || n > p.max {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter",
+				fmt.Sprintf("%s must be a number between %g and %g", p.name, p.min, p.max))
+			return
+		}
+		*p.dst = n
+	}
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	var candidates []Country
+	err := tx.Scopes(withCurrencies).Where("latitude IS NOT NULL AND longitude IS NOT NULL").Find(&candidates).Error
+	if err != nil {
+		respondDBError(c, err)
+		return
+	}
+
+	nearby := []NearbyCountry{}
+	for _, country := range candidates {
+		if d := haversineKM(lat, lng, *country.Latitude, *country.Longitude); d <= radius {
+			nearby = append(nearby, NearbyCountry{country, d})
+		}
+	}
+	slices.SortFunc(nearby, func(a, b NearbyCountry) int { return cmp.Compare(a.DistanceKM, b.DistanceKM) })
+
+	c.JSON(http.StatusOK, gin.H{"data": nearby})
+}
+
+// haversineKM returns the great-circle distance in km between two points
+// given in degrees.
+func haversineKM(lat1, lng1, lat2, lng2 float64) float64 {
+	const earthRadiusKM = 6371
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := rad(lat2 - lat1)
+	dLng := rad(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(lat1))*math.Cos(rad(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKM * math.Asin(math.Sqrt(a))
+}
+
+// RegionCount is the number of countries in a region
+type RegionCount struct {
+	Region string `json:"region"`
+	Count  int64  `json:"count"`
+}
+
+// CurrencySummary is a currency held by at least one stored country
+type CurrencySummary struct {
+	Code         string   `json:"code"`
+	ExchangeRate *float64 `json:"exchange_rate"`
+	Countries    int64    `json:"countries"`
+}
+
+// MarshalJSON rounds exchange_rate to 4 decimals, like Country.
+func (s CurrencySummary) MarshalJSON() ([]byte, error) {
+	type summary CurrencySummary
+	return json.Marshal(struct {
+		summary
+		ExchangeRate *float64 `json:"exchange_rate"`
+	}{summary(s), roundPtr(s.ExchangeRate, 4)})
+}
+
+// getCurrencies lists every currency held by a stored country, with its
+// rate from the last refresh and how many countries use it.
+func getCurrencies(c *gin.Context) {
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	currencies := []CurrencySummary{}
+	err := tx.Model(&CountryCurrency{}).
+		Select("country_currencies.code, MAX(country_currencies.exchange_rate) AS exchange_rate, COUNT(DISTINCT country_currencies.country_id) AS countries").
+		Joins("JOIN countries ON countries.id = country_currencies.country_id AND countries.deleted_at IS NULL").
+		Where("country_currencies.code IS NOT NULL AND country_currencies.code <> ''").
+		Group("country_currencies.code").
+		Order("country_currencies.code ASC").
+		Scan(&currencies).Error
+	if err != nil {
+		respondDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": currencies})
+}
+
+// getRegions lists each non-empty region with its country count, largest
+// first.
+func getRegions(c *gin.Context) {
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	regions := []RegionCount{}
+	err := tx.Model(&Country{}).
+		Select("region, COUNT(*) AS count").
+		Where("region <> ''").
+		Group("region").
+		Order("count DESC, region ASC").
+		Scan(&regions).Error
+	if err != nil {
+		respondDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": regions})
+}
+
+func restoreCountry(c *gin.Context) {
+	name := c.Param("name")
+	var country Country
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	if err := tx.Unscoped().Where("LOWER(name) = LOWER(?) AND deleted_at IS NOT NULL", name).First(&country).Error; err != nil {
+		respondLookupError(c, err, "Deleted country not found")
+		return
+	}
+
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		restored := map[string]any{"deleted_at": nil, "updated_at": time.Now()}
+		if err := tx.Unscoped().Model(&country).Updates(restored).Error; err != nil {
+			return err
+		}
+		return tx.Create(newAuditLogs(c, "restore", country.Name)).Error
+	})
+	if err != nil {
+		respondDBError(c, err)
+		return
+	}
+	statusCache.invalidate()
+	c.JSON(http.StatusOK, gin.H{"message": "Country restored successfully"})
+}
+
+func getCountryStats(c *gin.Context) {
+	var totals struct {
+		Count             int64
+		TotalPopulation   int64
+		AveragePopulation float64
+		TotalGDP          float64
+	}
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	err := tx.Model(&Country{}).
+		Select("COUNT(*) AS count, COALESCE(SUM(population), 0) AS total_population, " +
+			"COALESCE(AVG(population), 0) AS average_population, COALESCE(SUM(estimated_gdp), 0) AS total_gdp").
+		Scan(&totals).Error
+	if err != nil {
+		respondDBError(c, err)
+		return
+	}
+
+	byRegion := []RegionCount{}
+	err = tx.Model(&Country{}).
+		Select("region, COUNT(*) AS count").
+		Where("region <> ''").
+		Group("region").
+		Order("count DESC, region ASC").
+		Scan(&byRegion).Error
+	if err != nil {
+		respondDBError(c, err)
+		return
+	}
+
+	var missingRate int64
+	if err := tx.Model(&Country{}).Where("exchange_rate IS NULL").Count(&missingRate).Error; err != nil {
+		respondDBError(c, err)
+		return
+	}
+
+	var topRegion *RegionCount
+	if len(byRegion) > 0 {
+		topRegion = &byRegion[0]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total_countries":       totals.Count,
+		"total_population":      totals.TotalPopulation,
+		"average_population":    totals.AveragePopulation,
+		"total_estimated_gdp":   roundTo(totals.TotalGDP, 2),
+		"top_region":            topRegion,
+		"countries_by_region":   byRegion,
+		"missing_exchange_rate": missingRate,
+	})
+}
+
+// CountryPatch is the body of PATCH /countries/:name. Nil fields are left
+// unchanged.
+type CountryPatch struct {
+	Capital        *string `json:"capital"`
+	Region         *string `json:"region"`
+	Population     *int64  `json:"population"`
+	FlagURL        *string `json:"flag_url"`
+	ManualOverride *bool   `json:"manual_override"`
+}
+
+// patchCountry applies manual corrections. Patched fields are marked as
+// overridden and kept across refreshes until manual_override is set back to
+// false.
+func patchCountry(c *gin.Context) {
+	var patch CountryPatch
+	if !decodeJSON(c, &patch, false) {
+		return
+	}
+	if patch.Region != nil {
+		region, ok := canonicalRegion(*patch.Region)
+		if !ok {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid request body",
+				fmt.Sprintf("region must be one of: %s", strings.Join(knownRegions, ", ")))
+			return
+		}
+		patch.Region = &region
+	}
+	if patch.FlagURL != nil && *patch.FlagURL != "" && !allowedFlagURL(*patch.FlagURL) {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid request body",
+			fmt.Sprintf("flag_url must be an https URL on one of: %s", strings.Join(cfg.FlagHosts, ", ")))
+		return
+	}
+	if patch.Population != nil && *patch.Population < 0 {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid request body", "population must not be negative")
+		return
+	}
+
+	name := c.Param("name")
+	var country Country
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	if err := tx.Where("LOWER(name) = LOWER(?)", name).First(&country).Error; err != nil {
+		respondLookupError(c, err, "Country not found")
+		return
+	}
+
+	country.UpdatedAt = time.Now()
+	columns := []string{"manual_override", "overridden_fields", "updated_at"}
+	overridden := func(field string) {
+		columns = append(columns, field)
+		if !slices.Contains(country.OverriddenFields, field) {
+			country.OverriddenFields = append(country.OverriddenFields, field)
+		}
+		country.ManualOverride = true
+	}
+	if patch.Capital != nil {
+		country.Capital = *patch.Capital
+		overridden("capital")
+	}
+	if patch.Region != nil {
+		country.Region = *patch.Region
+		overridden("region")
+	}
+	if patch.Population != nil {
+		country.Population = *patch.Population
+		overridden("population")
+
+		// Keep GDP consistent with the corrected population
+		switch {
+		case country.Population == 0:
+			country.EstimatedGDP = nil
+			columns = append(columns, "estimated_gdp")
+		case country.ExchangeRate != nil:
+			country.EstimatedGDP = nil
+			if gdp, ok := estimateGDP(country.Population, *country.ExchangeRate, gdpSeed(country.Name)); ok {
+				country.EstimatedGDP = &gdp
+			}
+			columns = append(columns, "estimated_gdp")
+		}
+	}
+	if patch.FlagURL != nil {
+		country.FlagURL = *patch.FlagURL
+		overridden("flag_url")
+	}
+	if patch.ManualOverride != nil && !*patch.ManualOverride {
+		// Hand every field back to the next refresh
+		country.ManualOverride = false
+		country.OverriddenFields = []string{}
+	}
+	if country.OverriddenFields == nil {
+		country.OverriddenFields = []string{}
+	}
+
+	if err := tx.Model(&country).Select(columns).Updates(&country).Error; err != nil {
+		respondDBError(c, err)
+		return
+	}
+	if err := tx.Scopes(withCurrencies).First(&country, country.ID).Error; err != nil {
+		respondDBError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, country)
+}
+
+func deleteCountry(c *gin.Context) {
+	name := c.Param("name")
+	var country Country
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	if err := tx.Scopes(byIdentifier(name)).First(&country).Error; err != nil {
+		respondLookupError(c, err, "Country not found")
+		return
+	}
+
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&country).Error; err != nil {
+			return err
+		}
+		return tx.Create(newAuditLogs(c, "delete", country.Name)).Error
+	})
+	if err != nil {
+		respondDBError(c, err)
+		return
+	}
+	statusCache.invalidate()
+	c.JSON(http.StatusOK, gin.H{"message": "Country deleted successfully"})
+}
+
+// deleteCountryByID soft-deletes a country by primary key.
+func deleteCountryByID(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid path parameter", "id must be an unsigned integer")
+		return
+	}
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	var country Country
+	if err := tx.First(&country, id).Error; err != nil {
+		respondLookupError(c, err, "Country not found")
+		return
+	}
+
+	err = tx.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&country).Error; err != nil {
+			return err
+		}
+		return tx.Create(newAuditLogs(c, "delete", country.Name)).Error
+	})
+	if err != nil {
+		respondDBError(c, err)
+		return
+	}
+	statusCache.invalidate()
+	c.JSON(http.StatusOK, gin.H{"message": "Country deleted successfully"})
+}
+
+// countryFilterParams are the query params read by filterCountries
+var countryFilterParams = []string{"region", "currency", "search", "startsWith", "minPopulation", "maxPopulation", "hasRate"}
+
+// deleteCountries soft-deletes every country matching the GET /countries
+// filters, writing an audit row per country in the same transaction. At
+// least one filter is required so the whole table can't be wiped by
+// accident.
+func deleteCountries(c *gin.Context) {
+	if !slices.ContainsFunc(countryFilterParams, func(p string) bool { return c.Query(p) != "" }) {
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter",
+			fmt.Sprintf("At least one filter is required: %s", strings.Join(countryFilterParams, ", ")))
+		return
+	}
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	var deleted int64
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		query, err := filterCountries(c, tx, tx.Model(&Country{}))
+		if err != nil {
+			return err
+		}
+		var matched []Country
+		if err := query.Select("id", "name").Find(&matched).Error; err != nil {
+			return err
+		}
+		if len(matched) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, len(matched))
+		names := make([]string, len(matched))
+		for i, country := range matched {
+			ids[i], names[i] = country.ID, country.Name
+		}
+		result := tx.Delete(&Country{}, ids)
+		if result.Error != nil {
+			return result.Error
+		}
+		deleted = result.RowsAffected
+		return tx.Create(newAuditLogs(c, "delete", names...)).Error
+	})
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+	statusCache.invalidate()
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Countries deleted successfully",
+		"deleted": deleted,
+	})
+}
+
+// getAuditLogs returns the most recent deletes and restores, newest first.
+func getAuditLogs(c *gin.Context) {
+	limit := 50
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 200 {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid query parameter",
+				"limit must be an integer between 1 and 200")
+			return
+		}
+		limit = n
+	}
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	logs := []AuditLog{}
+	if err := tx.Order("created_at DESC, id DESC").Limit(limit).Find(&logs).Error; err != nil {
+		respondDBError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": logs})
+}
+
+// nullTime returns a pointer to t's time, or nil when it is NULL.
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// statusCache holds the last /status body for STATUS_CACHE_TTL, so
+// frequent probes don't each query the tables. Refreshes, deletes, and
+// restores invalidate it.
+var statusCache cachedStatus
+
+type cachedStatus struct {
+	mu   sync.Mutex
+	body gin.H
+	at   time.Time
+	// gen is bumped by invalidate so a body computed before the change
+	// isn't stored after it
+	gen uint64
+}
+
+// get returns the cached body if it is younger than ttl, and the generation
+// to pass to set.
+func (s *cachedStatus) get(ttl time.Duration) (gin.H, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.body != nil && time.Since(s.at) < ttl {
+		return s.body, s.gen
+	}
+	return nil, s.gen
+}
+
+// set caches body unless the cache was invalidated since gen was read.
+func (s *cachedStatus) set(body gin.H, gen uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gen == gen {
+		s.body, s.at = body, time.Now()
+	}
+}
+
+func (s *cachedStatus) invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.body = nil
+	s.gen++
+}
+
+func getStatus(c *gin.Context) {
+	ttl := envDuration("STATUS_CACHE_TTL", 5*time.Second)
+	body, gen := statusCache.get(ttl)
+	if body == nil {
+		var err error
+		if body, err = loadStatus(c.Request.Context()); err != nil {
+			respondDBError(c, err)
+			return
+		}
+		if ttl > 0 {
+			statusCache.set(body, gen)
+		}
+	}
+
+	// has_data is in memory, so it is never stale
+	body = maps.Clone(body)
+	body["has_data"] = hasData.Load()
+	c.JSON(http.StatusOK, body)
+}
+
+// loadStatus queries the fields of /status that come from the database.
+func loadStatus(ctx context.Context) (gin.H, error) {
+	tx, cancel := queryDB(ctx)
+	defer cancel()
+
+	var count int64
+	if err := tx.Model(&Country{}).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	lastRefresh, err := lastRefreshTime(tx)
+	if err != nil {
+		return nil, err
+	}
+	var ratesAsOf sql.NullTime
+	if err := tx.Model(&Country{}).Select("MAX(rates_as_of)").Scan(&ratesAsOf).Error; err != nil {
+		return nil, err
+	}
+	var logs []RefreshLog
+	if err := tx.Order("started_at DESC").Limit(1).Find(&logs).Error; err != nil {
+		return nil, err
+	}
+	var lastLog *RefreshLog
+	if len(logs) > 0 {
+		lastLog = &logs[0]
+	}
+
+	return gin.H{
+		"total_countries":   count,
+		"last_refreshed_at": lastRefresh,
+		"rates_as_of":       nullTime(ratesAsOf),
+		"last_refresh":      lastLog,
+	}, nil
+}
+
+// getHealth pings the database so liveness/readiness probes can detect an
+// unreachable database without running any queries.
+func getHealth(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	sqlDB, err := db.DB()
+	if err == nil {
+		err = sqlDB.PingContext(ctx)
+	}
+	if err != nil {
+		logger(c.Request.Context()).Error("Health check failed", "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// openAPISpec is the hand-maintained OpenAPI 3 document for every route;
+// update it alongside the handlers
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func getOpenAPISpec(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json", openAPISpec)
+}
+
+func getCountryImage(c *gin.Context) {
+	opts, err := parseSummaryOptions(c)
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+
+	// Any image on disk predates the data from the failed refresh
+	if failedAt, failed := summaryImageFailure.get(); failed {
+		respondError(c, http.StatusServiceUnavailable, ErrCodeImageUnavailable, "Summary image unavailable",
+			fmt.Sprintf("Generating the image after the refresh at %s failed; it is retried on the next refresh",
+				failedAt.Format(time.RFC3339)))
+		return
+	}
+
+	// Until the first refresh, serve a placeholder so <img> tags still
+	// get an image
+	summaryPath := cacheFile(summaryImageFile)
+	summary, err := os.Stat(summaryPath)
+	if os.IsNotExist(err) {
+		servePlaceholderImage(c, opts)
+		return
+	}
+	if opts == defaultSummaryOptions {
+		c.File(summaryPath)
+		return
+	}
+
+	// Variants are regenerated whenever the main summary is newer
+	path := opts.cachePath()
+	if variant, err := os.Stat(path); err != nil || variant.ModTime().Before(summary.ModTime()) {
+		if err := generateSummaryImage(c.Request.Context(), opts, path); err != nil {
+			logger(c.Request.Context()).Error("Failed to generate image", "error", err)
+			servePlaceholderImage(c, opts)
+			return
+		}
+		evictSummaryVariants(envInt("SUMMARY_VARIANT_LIMIT", 50))
+	} else {
+		// Mark it recently used for eviction; still newer than the summary
+		now := time.Now()
+		os.Chtimes(path, now, now)
+	}
+
+	c.File(path)
+}
+
+// evictSummaryVariants removes the least recently used cached summary
+// variants beyond the newest keep, so arbitrary sizes can't fill the disk.
+func evictSummaryVariants(keep int) {
+	paths, _ := filepath.Glob(cacheFile("summary_*.png"))
+	if len(paths) <= keep {
+		return
+	}
+	used := make(map[string]time.Time, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			used[path] = info.ModTime()
+		}
+	}
+	slices.SortFunc(paths, func(a, b string) int { return used[b].Compare(used[a]) })
+	for _, path := range paths[max(keep, 0):] {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			slog.Warn("Failed to remove summary variant", "path", path, "error", err)
+		}
+	}
+}
+
+// getCountryImageSVG renders the summary as SVG on every request; it takes
+// the same width, height, and top params as the PNG.
+func getCountryImageSVG(c *gin.Context) {
+	opts, err := parseSummaryOptions(c)
+	if err != nil {
+		respondFilterError(c, err)
+		return
+	}
+
+	data, err := loadSummaryData(c.Request.Context(), opts)
+	if err != nil {
+		respondDBError(c, err)
+		return
+	}
+	if data.LastRefresh.IsZero() {
+		c.Header("Cache-Control", "no-store")
+	}
+	c.Data(http.StatusOK, "image/svg+xml", renderSummarySVG(data, opts))
+}
+
+// servePlaceholderImage renders a "no data yet" PNG at the requested size.
+// It is never cached by clients since a refresh will replace it.
+func servePlaceholderImage(c *gin.Context, opts summaryOptions) {
+	canvas := newPNGCanvas(opts.Width, opts.Height)
+	if err := canvas.loadFont(); err == nil {
+		drawPlaceholder(canvas, opts)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas.img); err != nil {
+		logger(c.Request.Context()).Error("Failed to encode placeholder image", "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "Internal server error", "Could not generate image")
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "image/png", buf.Bytes())
+}
+
+// summaryFont is the parsed IMAGE_FONT, or Go Regular when it is unset or
+// can't be loaded. It is parsed once, on first use.
+var summaryFont = sync.OnceValues(func() (*truetype.Font, error) {
+	if path := cfg.ImageFont; path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			var font *truetype.Font
+			if font, err = truetype.Parse(data); err == nil {
+				return font, nil
+			}
+		}
+		slog.Warn("Failed to load image font, using Go Regular", "path", path, "error", err)
+	}
+	return truetype.Parse(goregular.TTF)
+})
+
+// cacheFile returns the path of a file under the cache directory.
+func cacheFile(elem ...string) string {
+	return filepath.Join(append([]string{cfg.CacheDir}, elem...)...)
+}
+
+const summaryImageFile = "summary.png"
+
+// summaryImageFailure records whether generating the summary image after
+// the last refresh failed. It is in memory only, so a restart clears it.
+var summaryImageFailure imageFailure
+
+type imageFailure struct {
+	mu       sync.Mutex
+	failed   bool
+	failedAt time.Time
+}
+
+// set records the outcome of a generation; a nil err clears the failure.
+func (f *imageFailure) set(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failed = err != nil
+	f.failedAt = time.Now()
+}
+
+// get returns when generation failed, if the last attempt did.
+func (f *imageFailure) get() (time.Time, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.failedAt, f.failed
+}
+
+// summaryOptions controls the size and content of a summary image
+type summaryOptions struct {
+	Width  int
+	Height int
+	Top    int
+	// Region restricts the totals and top countries; empty means all
+	Region string
+}
+
+var defaultSummaryOptions = summaryOptions{Width: 800, Height: 600, Top: defaultTopLimit}
+
+// cachePath returns where the image variant for these options is cached. A
+// region at the default size is cached as summary_<region>.png.
+func (o summaryOptions) cachePath() string {
+	size := fmt.Sprintf("%dx%d_top%d", o.Width, o.Height, o.Top)
+	if o.Region == "" {
+		return cacheFile("summary_" + size + ".png")
+	}
+	region := strings.Map(func(r rune) rune {
+		if r < 128 && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+		return '-'
+	}, o.Region)
+	sized := o
+	sized.Region = ""
+	if sized == defaultSummaryOptions {
+		return cacheFile("summary_" + region + ".png")
+	}
+	return cacheFile("summary_" + region + "_" + size + ".png")
+}
+
+// parseSummaryOptions reads the width, height, top, and region query
+// params, falling back to the defaults for any that are absent. Invalid
+// params are reported as an invalidParamError; the region is matched
+// against the database like the country filters.
+func parseSummaryOptions(c *gin.Context) (summaryOptions, error) {
+	opts := defaultSummaryOptions
+	params := []struct {
+		name     string
+		dst      *int
+		min, max int
+	}{
+		{"width", &opts.Width, 200, 4000},
+		{"height", &opts.Height, 200, 4000},
+		{"top", &opts.Top, 1, maxTopLimit},
+	}
+	for _, p := range params {
+		v := c.Query(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < p.min || n > p.max {
+			return opts, invalidParamError(fmt.Sprintf("%s must be an integer between %d and %d", p.name, p.min, p.max))
+		}
+		*p.dst = n
+	}
+
+	if region := c.Query("region"); region != "" {
+		tx, cancel := queryDB(c.Request.Context())
+		defer cancel()
+		canonical, valid, err := resolveRegion(tx, region)
+		if err != nil {
+			return opts, err
+		}
+		if canonical == "" {
+			return opts, invalidParamError(fmt.Sprintf("region must be one of: %s", strings.Join(valid, ", ")))
+		}
+		opts.Region = canonical
+	}
+	return opts, nil
+}
+
+func getCountryFlag(c *gin.Context) {
+	name := c.Param("name")
+	var country Country
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	if err := tx.Where("LOWER(name) = LOWER(?)", name).First(&country).Error; err != nil {
+		respondLookupError(c, err, "Country not found")
+		return
+	}
+	if country.FlagURL == "" {
+		respondError(c, http.StatusNotFound, ErrCodeImageNotFound, "Flag not found", "")
+		return
+	}
+
+	data, contentType, err := cachedFlag(c.Request.Context(), country.FlagURL)
+	if err != nil {
+		logger(c.Request.Context()).Error("Failed to fetch flag", "url", country.FlagURL, "error", err)
+		respondError(c, http.StatusBadGateway, ErrCodeUpstreamUnavailable, "External data source unavailable", "Could not fetch flag image")
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.Header("X-Content-Type-Options", "nosniff")
+	if strings.HasPrefix(contentType, "image/svg+xml") {
+		// SVG can carry script; keep it inert on the API's origin
+		c.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	}
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// getCountryCard serves a 1200x630 PNG share card with the country's flag,
+// name, capital, population, and estimated GDP. Cards are cached until any
+// of those change.
+func getCountryCard(c *gin.Context) {
+	name := c.Param("name")
+	var country Country
+
+	tx, cancel := queryDB(c.Request.Context())
+	defer cancel()
+
+	if err := tx.Where("LOWER(name) = LOWER(?)", name).First(&country).Error; err != nil {
+		respondLookupError(c, err, "Country not found")
+		return
+	}
+
+	path := cardPath(country)
+	if _, err := os.Stat(path); err == nil {
+		c.Header("Cache-Control", "public, max-age=3600")
+		c.File(path)
+		return
+	}
+
+	// A card without its flag is still served, but not cached, so the
+	// flag is retried on the next request
+	flag, err := countryFlagImage(c.Request.Context(), country)
+	if err != nil {
+		logger(c.Request.Context()).Warn("Drawing card without flag", "country", country.Name, "url", country.FlagURL, "error", err)
+	}
+	data, err := renderCountryCard(country, flag)
+	if err != nil {
+		logger(c.Request.Context()).Error("Failed to render country card", "country", country.Name, "error", err)
+		respondError(c, http.StatusInternalServerError, ErrCodeInternal, "Failed to generate image", "")
+		return
+	}
+	if flag != nil {
+		// Drop the country's outdated cards before caching the new one
+		old, _ := filepath.Glob(cacheFile(cardCacheDir, fmt.Sprintf("%d_*.png", country.ID)))
+		for _, p := range old {
+			os.Remove(p)
+		}
+		if err := writeFileAtomic(path, data); err != nil {
+			logger(c.Request.Context()).Warn("Failed to cache country card", "path", path, "error", err)
+		}
+		c.Header("Cache-Control", "public, max-age=3600")
+	} else {
+		c.Header("Cache-Control", "no-store")
+	}
+	c.Data(http.StatusOK, "image/png", data)
+}
+
+const cardCacheDir = "cards"
+
+// cardPath keys a country's card on everything drawn on it, so a refresh
+// or patch that changes the card also changes the path.
+func cardPath(country Country) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s|%s|%d|%s|%s|%s|%s|%s|%s", country.Name, country.Capital, country.Population,
+		formatOptionalFloat(country.EstimatedGDP), cfg.BaseCurrency, country.FlagURL,
+		hexColor(cfg.ImageBackground), hexColor(cfg.ImageForeground), cfg.ImageFont)
+	return cacheFile(cardCacheDir, fmt.Sprintf("%d_%x.png", country.ID, h.Sum64()))
+}
+
+// countryFlagImage fetches and decodes the flag through the flag cache.
+func countryFlagImage(ctx context.Context, country Country) (image.Image, error) {
+	if country.FlagURL == "" {
+		return nil, errors.New("country has no flag URL")
+	}
+	data, _, err := cachedFlag(ctx, rasterFlagURL(country.FlagURL))
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// rasterFlagURL maps an SVG flag on flagcdn.com, where restcountries links,
+// to its 320px PNG, since only raster images can be drawn. Other URLs are
+// returned unchanged.
+func rasterFlagURL(url string) string {
+	file, ok := strings.CutPrefix(url, "https://flagcdn.com/")
+	if code, svg := strings.CutSuffix(file, ".svg"); ok && svg && !strings.Contains(code, "/") {
+		return "https://flagcdn.com/w320/" + code + ".png"
+	}
+	return url
+}
+
+// renderCountryCard draws the share card, leaving the flag area empty when
+// flag is nil.
+func renderCountryCard(country Country, flag image.Image) ([]byte, error) {
+	canvas := newPNGCanvas(1200, 630)
+	if err := canvas.loadFont(); err != nil {
+		return nil, err
+	}
+
+	// Fit the flag into a 440x300 box on the left, keeping its aspect ratio
+	if flag != nil {
+		box := image.Rect(60, 165, 500, 465)
+		b := flag.Bounds()
+		ratio := math.Min(float64(box.Dx())/float64(b.Dx()), float64(box.Dy())/float64(b.Dy()))
+		w, h := int(float64(b.Dx())*ratio), int(float64(b.Dy())*ratio)
+		dst := image.Rect(0, 0, w, h).Add(box.Min).Add(image.Pt((box.Dx()-w)/2, (box.Dy()-h)/2))
+		xdraw.CatmullRom.Scale(canvas.img, dst, flag, b, draw.Over, nil)
+	}
+
+	capital, gdp := country.Capital, "N/A"
+	if capital == "" {
+		capital = "N/A"
+	}
+	if country.EstimatedGDP != nil {
+		gdp = formatBaseAmount(*country.EstimatedGDP)
+	}
+	// Shrink long names so they fit beside the flag
+	nameSize := math.Min(56, 56*18/float64(utf8.RuneCountInString(country.Name)))
+	canvas.text(560, 230, nameSize, country.Name)
+	canvas.text(560, 310, 28, "Capital: "+capital)
+	canvas.text(560, 360, 28, "Population: "+groupDigits(country.Population))
+	canvas.text(560, 410, 28, "Estimated GDP: "+gdp)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas.img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// groupDigits formats n with comma thousands separators.
+func groupDigits(n int64) string {
+	s := strconv.FormatInt(n, 10)
+	sign := ""
+	if n < 0 {
+		sign, s = "-", s[1:]
+	}
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return sign + s
+}
+
+const flagCacheDir = "flags"
+
+// cachedFlag returns the flag image at url from the disk cache, fetching it
+// when the cache is cold or older than FLAG_CACHE_TTL (default 24h). A stale
+// copy is served if the refetch fails.
+func cachedFlag(ctx context.Context, url string) ([]byte, string, error) {
+	if !allowedFlagURL(url) {
+		return nil, "", fmt.Errorf("flag URL %q is not on an allowed host", url)
+	}
+
+	// Key the cache on the URL so a changed flag URL is refetched
+	h := fnv.New64a()
+	h.Write([]byte(url))
+	ext := strings.ToLower(filepath.Ext(strings.SplitN(url, "?", 2)[0]))
+	path := cacheFile(flagCacheDir, fmt.Sprintf("%x%s", h.Sum64(), ext))
+
+	contentType := mime.TypeByExtension(ext)
+	detect := func(data []byte) string {
+		if contentType != "" {
+			return contentType
+		}
+		return http.DetectContentType(data)
+	}
+
+	cached, statErr := os.Stat(path)
+	if statErr == nil && time.Since(cached.ModTime()) < envDuration("FLAG_CACHE_TTL", 24*time.Hour) {
+		if data, err := os.ReadFile(path); err == nil {
+			return data, detect(data), nil
+		}
+	}
+
+	data, err := fetchFlag(ctx, url)
+	if err != nil {
+		if statErr == nil {
+			if stale, readErr := os.ReadFile(path); readErr == nil {
+				logger(ctx).Warn("Serving stale flag", "url", url, "error", err)
+				return stale, detect(stale), nil
+			}
+		}
+		return nil, "", err
+	}
+
+	if err := writeFileAtomic(path, data); err != nil {
+		logger(ctx).Warn("Failed to cache flag", "url", url, "error", err)
+	}
+	return data, detect(data), nil
+}
+
+// maxFlagBytes caps how much of a remote flag image is read
+const maxFlagBytes = 5 << 20
+
+// allowedFlagURL reports whether raw is an https URL on a FLAG_HOSTS host,
+// so flags can't be used to make the server fetch internal addresses.
+func allowedFlagURL(raw string) bool {
+	u, err := neturl.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.User != nil || (u.Port() != "" && u.Port() != "443") {
+		return false
+	}
+	return slices.ContainsFunc(cfg.FlagHosts, func(host string) bool { return strings.EqualFold(host, u.Hostname()) })
+}
+
+func fetchFlag(ctx context.Context, url string) ([]byte, error) {
+	// Redirects must stay on allowed hosts too
+	client := *httpClient
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if !allowedFlagURL(req.URL.String()) {
+			return fmt.Errorf("redirect to %s is not on an allowed host", req.URL.Host)
+		}
+		return nil
+	}
+	resp, err := getWithRetry(ctx, &client, url)
+	if err != nil {
+		return nil, err
 	}
-	defer file.Close()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("flag host returned status %d", resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxFlagBytes))
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it
+// into place so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// errTooFewCountries means upstream answered with a suspiciously short list,
+// as it has during outages
+var errTooFewCountries = errors.New("too few countries")
+
+// checkCountryCount rejects lists shorter than MIN_COUNTRIES so a bad
+// upstream response is never cached or saved.
+func checkCountryCount(countries []RestCountry) error {
+	if minimum := envInt("MIN_COUNTRIES", 50); len(countries) < minimum {
+		return fmt.Errorf("%w: got %d, want at least %d", errTooFewCountries, len(countries), minimum)
+	}
+	return nil
+}
+
+// fetchCountries fetches from the restcountries v2 API, falling back to
+// v3.1 when v2 fails.
+func fetchCountries(ctx context.Context) ([]RestCountry, error) {
+	log := logger(ctx)
+	countries, err := fetchCountriesV2(ctx)
+	if err == nil {
+		err = checkCountryCount(countries)
+	}
+	if err == nil {
+		log.Info("Fetched countries", "source", "restcountries v2", "count", len(countries))
+		return countries, nil
+	}
+	log.Warn("restcountries v2 failed, falling back to v3.1", "error", err)
+
+	countries, errV3 := fetchCountriesV3(ctx)
+	if errV3 == nil {
+		errV3 = checkCountryCount(countries)
+	}
+	if errV3 != nil {
+		return nil, fmt.Errorf("v2: %w; v3.1: %w", err, errV3)
+	}
+	log.Info("Fetched countries", "source", "restcountries v3.1", "count", len(countries))
+	return countries, nil
+}
+
+func fetchCountriesV2(ctx context.Context) ([]RestCountry, error) {
+	body, err := fetchUpstreamBody(ctx, cfg.CountriesAPIURL+"/v2/all?fields=name,capital,region,population,flag,currencies,alpha2Code,alpha3Code,borders,latlng",
+		cacheFile(upstreamCountriesFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var countries []RestCountry
+	if err := json.Unmarshal(body, &countries); err != nil {
+		return nil, err
+	}
+
+	return countries, nil
+}
+
+func fetchCountriesV3(ctx context.Context) ([]RestCountry, error) {
+	body, err := fetchUpstreamBody(ctx, cfg.CountriesAPIURL+"/v3.1/all?fields=name,capital,region,population,flags,currencies,cca2,cca3,borders,latlng",
+		cacheFile(upstreamCountriesFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var v3 []RestCountryV3
+	if err := json.Unmarshal(body, &v3); err != nil {
+		return nil, err
+	}
+
+	countries := make([]RestCountry, len(v3))
+	for i, rc := range v3 {
+		countries[i] = rc.toRestCountry()
+	}
+	return countries, nil
+}
+
+// rateProvider is an exchange rate API. fetch returns rates relative to
+// base.
+type rateProvider interface {
+	fetch(ctx context.Context, base string) (ExchangeRates, error)
+}
+
+// rateProviders are the providers RATE_PROVIDERS can list, by name
+var rateProviders = map[string]rateProvider{
+	"open-er-api":  openERAPI{},
+	"currency-api": currencyAPI{},
+}
+
+// fetchExchangeRates tries the RATE_PROVIDERS in order and returns the
+// first valid rates.
+func fetchExchangeRates(ctx context.Context) (ExchangeRates, error) {
+	log := logger(ctx)
+	var errs []string
+	for _, name := range cfg.RateProviders {
+		rates, err := rateProviders[name].fetch(ctx, cfg.BaseCurrency)
+		if err == nil {
+			err = checkRates(rates)
+		}
+		if err == nil {
+			log.Info("Fetched exchange rates", "provider", name, "count", len(rates.Rates))
+			return rates, nil
+		}
+		log.Warn("Exchange rate provider failed", "provider", name, "error", err)
+		errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+	}
+	return ExchangeRates{}, errors.New(strings.Join(errs, "; "))
+}
+
+// openERAPI fetches from open.er-api.com, or EXCHANGE_API_URL
+type openERAPI struct{}
+
+func (openERAPI) fetch(ctx context.Context, base string) (ExchangeRates, error) {
+	body, err := fetchUpstreamBody(ctx, cfg.ExchangeAPIURL+"/v6/latest/"+base, cacheFile(upstreamRatesFile))
+	if err != nil {
+		return ExchangeRates{}, err
+	}
+
+	var rates ExchangeRates
+	if err := json.Unmarshal(body, &rates); err != nil {
+		return ExchangeRates{}, err
+	}
+	return rates, nil
+}
+
+// currencyAPI fetches from the free currency-api on jsDelivr, or
+// CURRENCY_API_URL. It keys rates by lowercase code under the base and
+// dates them by day.
+type currencyAPI struct{}
+
+func (currencyAPI) fetch(ctx context.Context, base string) (ExchangeRates, error) {
+	base = strings.ToLower(base)
+	body, err := fetchUpstreamBody(ctx, cfg.CurrencyAPIURL+"/currencies/"+base+".json", cacheFile(upstreamRatesFile))
+	if err != nil {
+		return ExchangeRates{}, err
+	}
+
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return ExchangeRates{}, err
+	}
+	var quoted map[string]float64
+	if err := json.Unmarshal(payload[base], &quoted); err != nil {
+		return ExchangeRates{}, fmt.Errorf("rates for %s: %w", base, err)
+	}
+
+	rates := ExchangeRates{Rates: make(map[string]float64, len(quoted))}
+	for code, rate := range quoted {
+		rates.Rates[strings.ToUpper(code)] = rate
+	}
+	var date string
+	if json.Unmarshal(payload["date"], &date) == nil {
+		if t, err := time.Parse(time.DateOnly, date); err == nil {
+			rates.LastUpdateUnix = t.Unix()
+		}
+	}
+	return rates, nil
+}
+
+// checkRates drops invalid rates and rejects rates that don't quote the
+// base currency.
+func checkRates(rates ExchangeRates) error {
+	// Zero or negative rates have come back for obscure currencies; those
+	// currencies are treated as having no rate
+	var invalid []string
+	for code, rate := range rates.Rates {
+		if !validRate(rate) {
+			invalid = append(invalid, code)
+			delete(rates.Rates, code)
+		}
+	}
+	if len(invalid) > 0 {
+		slices.Sort(invalid)
+		slog.Warn("Dropped invalid exchange rates", "currencies", invalid)
+	}
+
+	// The base always quotes itself at 1; a missing entry means upstream
+	// doesn't know the currency
+	if _, ok := rates.Rates[cfg.BaseCurrency]; !ok {
+		return fmt.Errorf("base currency %s is not in the exchange rates", cfg.BaseCurrency)
+	}
+	return nil
+}
+
+// The last raw upstream bodies, kept in the cache directory for
+// GET /debug/upstream/*
+const (
+	upstreamCountriesFile = "upstream_countries.json.gz"
+	upstreamRatesFile     = "upstream_rates.json.gz"
+)
+
+// upstreamErrorBodyLen is how much of an error response body is kept
+const upstreamErrorBodyLen = 200
+
+// upstreamError is a failed upstream request: either a response other than
+// 200, with the start of its body, or no response at all.
+type upstreamError struct {
+	url    string
+	status int
+	body   string
+	err    error
+}
+
+func (e *upstreamError) Error() string {
+	if e.status == 0 {
+		return e.err.Error()
+	}
+	if e.body == "" {
+		return fmt.Sprintf("API returned status %d", e.status)
+	}
+	return fmt.Sprintf("API returned status %d: %s", e.status, e.body)
+}
+func (e *upstreamError) Unwrap() error { return e.err }
+
+// describe says what went wrong without the full URL or transport detail,
+// for error responses.
+func (e *upstreamError) describe() string {
+	source, _, _ := strings.Cut(e.url, "?")
+	if _, rest, ok := strings.Cut(source, "://"); ok {
+		source = rest
+	}
+	var netErr net.Error
+	switch {
+	case e.status != 0 && e.body != "":
+		return fmt.Sprintf("%s returned status %d: %s", source, e.status, e.body)
+	case e.status != 0:
+		return fmt.Sprintf("%s returned status %d", source, e.status)
+	case errors.As(e.err, &netErr) && netErr.Timeout():
+		return source + " timed out"
+	default:
+		return source + " could not be reached"
+	}
+}
+
+// describeUpstreamError joins the descriptions of every upstreamError in
+// err's tree, such as both restcountries versions failing.
+func describeUpstreamError(err error) string {
+	var descriptions []string
+	var walk func(error)
+	walk = func(err error) {
+		switch e := err.(type) {
+		case *upstreamError:
+			descriptions = append(descriptions, e.describe())
+		case interface{ Unwrap() []error }:
+			for _, err := range e.Unwrap() {
+				walk(err)
+			}
+		case interface{ Unwrap() error }:
+			walk(e.Unwrap())
+		}
+	}
+	walk(err)
+	if len(descriptions) == 0 {
+		return "invalid response"
+	}
+	return strings.Join(descriptions, "; ")
+}
+
+// bodySnippet returns the start of an error body as printable text, cut
+// to upstreamErrorBodyLen runes.
+func bodySnippet(body []byte) string {
+	text := strings.Join(strings.Fields(strings.ToValidUTF8(string(body), "\uFFFD")), " ")
+	text = strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, text)
+	if utf8.RuneCountInString(text) > upstreamErrorBodyLen {
+		text = string([]rune(text)[:upstreamErrorBodyLen]) + "…"
+	}
+	return text
+}
+
+// fetchUpstreamBody GETs url and returns the body of a 200 response. The
+// body is also saved gzipped to path, before it is decoded, so a payload
+// that fails to parse can still be inspected. Failed requests return an
+// *upstreamError.
+func fetchUpstreamBody(ctx context.Context, url, path string) ([]byte, error) {
+	resp, err := getWithRetry(ctx, httpClient, url)
+	if err != nil {
+		return nil, &upstreamError{url: url, err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// Read a little past the cut so the snippet is marked as truncated
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4*upstreamErrorBodyLen+4))
+		return nil, &upstreamError{url: url, status: resp.StatusCode, body: bodySnippet(body)}
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := saveUpstreamPayload(url, body, path); err != nil {
+		slog.Warn("Failed to save upstream payload", "path", path, "error", err)
+	}
+	return body, nil
+}
+
+// saveUpstreamPayload gzips body to path, recording url and the fetch time
+// in the gzip header.
+func saveUpstreamPayload(url string, body []byte, path string) error {
+	file, err := os.CreateTemp(filepath.Dir(path), ".upstream-*.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	gz := gzip.NewWriter(file)
+	gz.Name = url
+	gz.ModTime = time.Now()
+	if _, err := gz.Write(body); err != nil {
+		file.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// getUpstreamPayload serves the last raw body saved at path, as-is to
+// clients that accept gzip and decompressed otherwise. X-Upstream-URL and
+// Last-Modified say where and when it was fetched.
+func getUpstreamPayload(path string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			respondError(c, http.StatusNotFound, ErrCodePayloadNotFound, "No upstream payload saved yet", "Run a refresh first")
+			return
+		}
+		var gz *gzip.Reader
+		if err == nil {
+			gz, err = gzip.NewReader(bytes.NewReader(data))
+		}
+		if err != nil {
+			logger(c.Request.Context()).Error("Failed to read upstream payload", "path", path, "error", err)
+			respondError(c, http.StatusInternalServerError, ErrCodeInternal, "Internal server error", "Could not read the saved payload")
+			return
+		}
+		defer gz.Close()
+
+		c.Header("X-Upstream-URL", gz.Name)
+		c.Header("Last-Modified", gz.ModTime.UTC().Format(http.TimeFormat))
+		c.Header("Cache-Control", "no-store")
+		if acceptsGzip(c.GetHeader("Accept-Encoding")) {
+			c.Header("Content-Encoding", "gzip")
+			c.Data(http.StatusOK, "application/json", data)
+			return
+		}
+		c.DataFromReader(http.StatusOK, -1, "application/json", gz, nil)
+	}
+}
+
+// cachedValue memoizes the result of a successful fetch for
+// UPSTREAM_CACHE_TTL (default 10m).
+type cachedValue[T any] struct {
+	mu        sync.Mutex
+	value     T
+	fetchedAt time.Time
+}
+
+// get returns the cached value if it is still fresh, otherwise it calls
+// fetch with ctx and caches the result on success. force skips the cache.
+func (cv *cachedValue[T]) get(ctx context.Context, force bool, fetch func(context.Context) (T, error)) (T, error) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+
+	if !force && !cv.fetchedAt.IsZero() && time.Since(cv.fetchedAt) < cfg.CacheTTL {
+		return cv.value, nil
+	}
+
+	value, err := fetch(ctx)
+	if err != nil {
+		return value, err
+	}
+	cv.value = value
+	cv.fetchedAt = time.Now()
+	return value, nil
+}
+
+// httpClient is shared by every upstream fetch so connections are reused.
+// main replaces it once the configured timeout is known.
+var httpClient = newHTTPClient(30 * time.Second)
+
+func newHTTPClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 10
+	transport.IdleConnTimeout = 90 * time.Second
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// getWithRetry performs a GET request, retrying network errors and 5xx
+// responses with exponential backoff. 4xx responses are returned as is.
+// Cancelling ctx aborts the request in flight and any wait between retries.
+func getWithRetry(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	retries := envInt("FETCH_RETRIES", 3)
+	delay := envDuration("FETCH_RETRY_DELAY", 500*time.Millisecond)
+	log := logger(ctx)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := client.Do(req)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			return resp, nil
+		}
+		if attempt >= retries || ctx.Err() != nil {
+			return resp, err
+		}
+		if err == nil {
+			resp.Body.Close()
+			log.Warn("Upstream request failed, retrying", "url", url, "status", resp.StatusCode)
+		} else {
+			log.Warn("Upstream request failed, retrying", "url", url, "error", err)
+		}
+		timer := time.NewTimer(delay << attempt)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// summaryData is what a summary image shows
+type summaryData struct {
+	Total       int64
+	TotalGDP    float64
+	Top         []Country
+	LastRefresh time.Time
+}
+
+// loadSummaryData fetches the country total, the total estimated GDP, and
+// the top countries by estimated GDP, all within opts.Region when set, and
+// the last refresh time.
+func loadSummaryData(ctx context.Context, opts summaryOptions) (summaryData, error) {
+	var data summaryData
+	tx, cancel := queryDB(ctx)
+	defer cancel()
+
+	inRegion := func(tx *gorm.DB) *gorm.DB {
+		if opts.Region != "" {
+			return tx.Where("region = ?", opts.Region)
+		}
+		return tx
+	}
+
+	// Get total countries
+	if err := tx.Model(&Country{}).Scopes(inRegion).Count(&data.Total).Error; err != nil {
+		return data, err
+	}
+
+	// SUM skips countries without a GDP estimate
+	err := tx.Model(&Country{}).Scopes(inRegion).Select("COALESCE(SUM(estimated_gdp), 0)").Scan(&data.TotalGDP).Error
+	if err != nil {
+		return data, err
+	}
+
+	// Get top N by GDP
+	err = tx.Scopes(inRegion, rankedBy(topMetrics["gdp"], opts.Top)).Find(&data.Top).Error
+	if err != nil {
+		return data, err
+	}
+
+	// The last refresh is global, so an empty region still gets a summary
+	data.LastRefresh, err = lastRefreshTime(tx)
+	return data, err
+}
+
+// generateSummaryImage renders the summary PNG to path. The layout is
+// designed for 800x600 and scaled to the requested dimensions.
+func generateSummaryImage(ctx context.Context, opts summaryOptions, path string) error {
+	data, err := loadSummaryData(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	canvas := newPNGCanvas(opts.Width, opts.Height)
+	if err := canvas.loadFont(); err != nil {
+		return err
+	}
+	drawSummary(canvas, data, opts)
+
+	// Write to a temp file and rename so readers never see a partial image
+	file, err := os.CreateTemp(filepath.Dir(path), ".summary-*.png")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := png.Encode(file, canvas.img); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// renderSummarySVG draws the same layout as generateSummaryImage as SVG,
+// or a "no data yet" placeholder before the first refresh.
+func renderSummarySVG(data summaryData, opts summaryOptions) []byte {
+	canvas := newSVGCanvas(opts.Width, opts.Height)
+	if data.LastRefresh.IsZero() {
+		drawPlaceholder(canvas, opts)
+	} else {
+		drawSummary(canvas, data, opts)
+	}
+	return canvas.bytes()
+}
+
+// summaryCanvas is what the summary layout is drawn on. Coordinates are in
+// pixels and text is positioned by its baseline.
+type summaryCanvas interface {
+	text(x, y, size float64, s string)
+	bar(x, y, width, height float64)
+}
+
+// The layout is designed for 800x600 and scaled to the requested size
+func summaryScale(opts summaryOptions) float64 {
+	return math.Min(float64(opts.Width)/800, float64(opts.Height)/600)
+}
+
+func drawPlaceholder(c summaryCanvas, opts summaryOptions) {
+	scale := summaryScale(opts)
+	c.text(50*scale, 80*scale, 24*scale, "No data yet")
+	c.text(50*scale, 140*scale, 18*scale, "Run a refresh to generate the summary")
+}
+
+// drawSummary draws the title, total, top countries chart, and timestamp.
+func drawSummary(c summaryCanvas, data summaryData, opts summaryOptions) {
+	scale := summaryScale(opts)
+	title := "Country Data Summary"
+	if opts.Region != "" {
+		title += ": " + opts.Region
+	}
+	c.text(50*scale, 80*scale, 24*scale, title)
+	c.text(50*scale, 140*scale, 18*scale, fmt.Sprintf("Total Countries: %d", data.Total))
+	c.text(50*scale, 170*scale, 18*scale, fmt.Sprintf("Total Estimated GDP: %s", formatBaseAmount(data.TotalGDP)))
+	c.text(50*scale, 200*scale, 18*scale, fmt.Sprintf("Top %d Countries by Estimated GDP:", opts.Top))
+
+	footerY := float64(opts.Height) - 70*scale
+	drawTopCountries(c, data.Top, opts, 240*scale, footerY-30*scale)
+
+	c.text(50*scale, footerY, 16*scale, fmt.Sprintf("Last Refreshed: %s", data.LastRefresh.Format(time.RFC3339)))
+}
+
+// drawTopCountries draws one labelled bar per country between top and
+// bottom. Rows share the space evenly and bars are scaled so the largest GDP
+// fills the available width.
+func drawTopCountries(c summaryCanvas, countries []Country, opts summaryOptions, top, bottom float64) {
+	scale := summaryScale(opts)
+	rowHeight := (bottom - top) / float64(opts.Top)
+	row := func(v float64) float64 { return v * rowHeight / 52 }
+	barLeft := 70 * scale
+	barMaxWidth := float64(opts.Width) - barLeft - 50*scale
+
+	maxGDP := 0.0
+	if len(countries) > 0 && countries[0].EstimatedGDP != nil {
+		maxGDP = *countries[0].EstimatedGDP
+	}
+
+	fontSize := math.Min(14*scale, 14*rowHeight/52)
+	for i, country := range countries {
+		y := top + float64(i)*rowHeight
+		gdp := "N/A"
+		if country.EstimatedGDP != nil {
+			gdp = formatBaseAmount(*country.EstimatedGDP)
+
+			if maxGDP > 0 {
+				c.bar(barLeft, y+row(8), math.Max(*country.EstimatedGDP/maxGDP*barMaxWidth, 1), row(20))
+			}
+		}
+
+		// Label above the bar
+		c.text(barLeft, y, fontSize, fmt.Sprintf("%d. %s - %s", i+1, country.Name, gdp))
+	}
+}
+
+// formatBaseAmount formats an amount in the base currency, using "$" for
+// USD and the currency code otherwise.
+func formatBaseAmount(v float64) string {
+	if cfg.BaseCurrency == "USD" {
+		return fmt.Sprintf("$%.2f", v)
+	}
+	return fmt.Sprintf("%s %.2f", cfg.BaseCurrency, v)
+}
+
+// pngCanvas draws onto an RGBA image with freetype
+type pngCanvas struct {
+	img  *image.RGBA
+	font *freetype.Context
+}
+
+// newPNGCanvas returns a canvas filled with the background color. Call
+// loadFont before drawing text.
+func newPNGCanvas(width, height int) *pngCanvas {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(cfg.ImageBackground), image.Point{}, draw.Src)
+	return &pngCanvas{img: img}
+}
+
+func (p *pngCanvas) loadFont() error {
+	font, err := summaryFont()
+	if err != nil {
+		return err
+	}
+
+	c := freetype.NewContext()
+	c.SetDPI(72)
+	c.SetFont(font)
+	c.SetClip(p.img.Bounds())
+	c.SetDst(p.img)
+	c.SetSrc(image.NewUniform(cfg.ImageForeground))
+	p.font = c
+	return nil
+}
+
+func (p *pngCanvas) text(x, y, size float64, s string) {
+	p.font.SetFontSize(size)
+	p.font.DrawString(s, freetype.Pt(int(x), int(y)))
+}
+
+func (p *pngCanvas) bar(x, y, width, height float64) {
+	rect := image.Rect(int(x), int(y), int(x+width), int(y+height))
+	draw.Draw(p.img, rect, image.NewUniform(cfg.ImageBarColor), image.Point{}, draw.Src)
+}
+
+// svgCanvas writes SVG elements. It uses a generic sans-serif font since
+// IMAGE_FONT can't be referenced from the document.
+type svgCanvas struct {
+	b bytes.Buffer
+}
+
+func newSVGCanvas(width, height int) *svgCanvas {
+	s := &svgCanvas{}
+	fmt.Fprintf(&s.b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" fill="%s">`+"\n",
+		width, height, width, height, hexColor(cfg.ImageForeground))
+	fmt.Fprintf(&s.b, `<rect width="100%%" height="100%%" fill="%s"/>`+"\n", hexColor(cfg.ImageBackground))
+	return s
+}
+
+func (s *svgCanvas) text(x, y, size float64, text string) {
+	fmt.Fprintf(&s.b, `<text x="%.1f" y="%.1f" font-size="%.1f">%s</text>`+"\n", x, y, size, html.EscapeString(text))
+}
+
+func (s *svgCanvas) bar(x, y, width, height float64) {
+	fmt.Fprintf(&s.b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`+"\n",
+		x, y, width, height, hexColor(cfg.ImageBarColor))
+}
 
-	return png.Encode(file, img)
+func (s *svgCanvas) bytes() []byte {
+	s.b.WriteString("</svg>\n")
+	return s.b.Bytes()
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, served at /metrics
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Total HTTP requests by method, route, and status.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	refreshesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "country_refreshes_total",
+		Help: "Country refreshes by result (success or failure).",
+	}, []string{"result"})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "countries_total",
+		Help: "Countries currently stored.",
+	}, func() float64 {
+		var count int64
+		if db != nil {
+			tx, cancel := queryDB(context.Background())
+			defer cancel()
+			tx.Model(&Country{}).Count(&count)
+		}
+		return float64(count)
+	})
+)
+
+// metricsMiddleware records request counts and latency, labelled by route
+// template rather than raw path to keep cardinality bounded.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request.Method
+		httpRequestsTotal.WithLabelValues(method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpRequestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// recordRefresh counts a finished refresh as a success or failure.
+func recordRefresh(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	refreshesTotal.WithLabelValues(result).Inc()
+}
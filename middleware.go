@@ -0,0 +1,490 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+// apiKeyIDKey is the gin context key holding keyID of the request's API key
+const apiKeyIDKey = "api_key_id"
+
+// keyID identifies an API key in logs without revealing it: the first 12
+// hex digits of its SHA-256.
+func keyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// requestLogger assigns every request an X-Request-ID, reusing the client's
+// when it is reasonable, and logs the request as JSON once it completes.
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		id := c.GetHeader("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+		c.Header("X-Request-ID", id)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDKey, id))
+
+		c.Next()
+
+		logger(c.Request.Context()).Info("Request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"latency_ms", float64(time.Since(start).Microseconds())/1000,
+			"client_ip", c.ClientIP(),
+		)
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logger returns the default logger annotated with the request ID carried
+// by ctx, if any.
+func logger(ctx context.Context) *slog.Logger {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// ipRateLimiter keeps an in-memory token bucket per client IP
+type ipRateLimiter struct {
+	mu      sync.Mutex
+	limit   rate.Limit
+	burst   int
+	clients map[string]*clientBucket
+}
+
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newIPRateLimiter allows perMinute requests per client IP, refilled evenly
+// over the minute. Idle buckets are dropped periodically.
+func newIPRateLimiter(perMinute int) *ipRateLimiter {
+	l := &ipRateLimiter{
+		limit:   rate.Limit(float64(perMinute) / 60),
+		burst:   perMinute,
+		clients: make(map[string]*clientBucket),
+	}
+	go l.cleanup(time.Minute, 3*time.Minute)
+	return l
+}
+
+func (l *ipRateLimiter) bucket(ip string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.clients[ip]
+	if !ok {
+		b = &clientBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = b
+	}
+	b.lastSeen = time.Now()
+	return b.limiter
+}
+
+// cleanup removes buckets that have not been used for idle, every interval.
+func (l *ipRateLimiter) cleanup(interval, idle time.Duration) {
+	for range time.Tick(interval) {
+		l.mu.Lock()
+		for ip, b := range l.clients {
+			if time.Since(b.lastSeen) > idle {
+				delete(l.clients, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// middleware rejects requests over the limit with 429 and a Retry-After
+// header.
+func (l *ipRateLimiter) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		reservation := l.bucket(c.ClientIP()).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			c.Header("Retry-After", fmt.Sprint(int(math.Ceil(delay.Seconds()))))
+			respondError(c, http.StatusTooManyRequests, ErrCodeRateLimited, "Too many requests", "")
+			return
+		}
+		c.Next()
+	}
+}
+
+// rateLimit returns a per-IP rate limiting middleware, or a no-op when
+// perMinute is not positive.
+func rateLimit(perMinute int) gin.HandlerFunc {
+	if perMinute <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return newIPRateLimiter(perMinute).middleware()
+}
+
+// exceptRoutes runs h for every request except those matching one of the
+// route patterns.
+func exceptRoutes(h gin.HandlerFunc, routes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if slices.Contains(routes, c.FullPath()) {
+			c.Next()
+			return
+		}
+		h(c)
+	}
+}
+
+// maxBodySize caps request bodies at limit bytes; reads past the limit fail
+// and decodeJSON turns that into a 413. A non-positive limit disables it.
+func maxBodySize(limit int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limit > 0 && c.Request.Body != nil {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(limit))
+		}
+		c.Next()
+	}
+}
+
+// decodeJSON strictly decodes the request body into dst, rejecting unknown
+// fields and trailing data. On failure it responds with a 400 (or 413)
+// naming the offending field instead of leaking decoder errors, and returns
+// false. An empty body is accepted, leaving dst untouched, when optional is
+// set.
+func decodeJSON(c *gin.Context, dst any, optional bool) bool {
+	dec := json.NewDecoder(c.Request.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err == nil && dec.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("trailing data")
+	}
+	if err == nil || (optional && errors.Is(err, io.EOF)) {
+		return true
+	}
+
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+		sizeErr   *http.MaxBytesError
+		details   string
+	)
+	switch {
+	case errors.As(err, &sizeErr):
+		respondError(c, http.StatusRequestEntityTooLarge, ErrCodePayloadTooLarge, "Request body too large",
+			fmt.Sprintf("Body must not exceed %d bytes", sizeErr.Limit))
+		return false
+	case errors.Is(err, io.EOF):
+		details = "Request body is required"
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		details = "Body is not valid JSON"
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		details = fmt.Sprintf("Field %q must be %s", typeErr.Field, jsonTypeName(typeErr.Type))
+	case errors.As(err, &typeErr):
+		details = "Body must be a JSON object"
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		details = fmt.Sprintf("Unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	default:
+		details = "Body must contain a single JSON object"
+	}
+	respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid request body", details)
+	return false
+}
+
+// jsonTypeName describes t in JSON terms rather than Go ones.
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// requireAPIKey guards mutating endpoints. The key comes from
+// "Authorization: Bearer <key>" or X-API-Key and is compared in constant
+// time; a missing key is a 401 and an unknown one a 403. With no keys
+// configured every request is a 401, unless open (AUTH_DISABLED) lets them
+// all through.
+func requireAPIKey(keys []string, open bool) gin.HandlerFunc {
+	if len(keys) == 0 {
+		if open {
+			slog.Warn("AUTH_DISABLED is set, write endpoints are unauthenticated")
+			return func(c *gin.Context) { c.Next() }
+		}
+		return func(c *gin.Context) {
+			c.Header("WWW-Authenticate", "Bearer")
+			respondError(c, http.StatusUnauthorized, ErrCodeUnauthorized, "API key required", "No API keys are configured; set API_KEYS to enable this endpoint")
+		}
+	}
+
+	return func(c *gin.Context) {
+		key := requestAPIKey(c)
+		if key == "" {
+			c.Header("WWW-Authenticate", "Bearer")
+			respondError(c, http.StatusUnauthorized, ErrCodeUnauthorized, "API key required", "")
+			return
+		}
+		if !knownAPIKey(key, keys) {
+			respondError(c, http.StatusForbidden, ErrCodeForbidden, "Invalid API key", "")
+			return
+		}
+		c.Set(apiKeyIDKey, keyID(key))
+		c.Next()
+	}
+}
+
+// requireAdminKey is requireAPIKey for endpoints that expose internals,
+// like the audit log and raw upstream payloads. AUTH_DISABLED never opens
+// them.
+func requireAdminKey(keys []string) gin.HandlerFunc {
+	return requireAPIKey(keys, false)
+}
+
+// requestAPIKey returns the key sent in X-API-Key or as a bearer token, or
+// "" when there is none.
+func requestAPIKey(c *gin.Context) string {
+	key := c.GetHeader("X-API-Key")
+	if auth := c.GetHeader("Authorization"); key == "" && len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		key = strings.TrimSpace(auth[7:])
+	}
+	return key
+}
+
+// knownAPIKey reports whether key is one of keys. Every key is checked so
+// timing doesn't reveal which one matched.
+func knownAPIKey(key string, keys []string) bool {
+	valid := 0
+	for _, k := range keys {
+		valid |= subtle.ConstantTimeCompare([]byte(key), []byte(k))
+	}
+	return key != "" && valid == 1
+}
+
+// noWriteTimeout lifts the server's WRITE_TIMEOUT for handlers that can
+// legitimately run longer, like a refresh or an event stream.
+func noWriteTimeout(c *gin.Context) {
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		logger(c.Request.Context()).Warn("Failed to clear write deadline", "error", err)
+	}
+	c.Next()
+}
+
+// cors answers preflight requests and adds CORS headers for the allowed
+// origins, or any origin when the list contains "*". With no origins it is
+// a no-op, leaving the API same-origin only.
+func cors(origins []string) gin.HandlerFunc {
+	if len(origins) == 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+	anyOrigin := slices.Contains(origins, "*")
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		allowed := origin != "" && (anyOrigin || slices.Contains(origins, origin))
+		if !anyOrigin {
+			c.Writer.Header().Add("Vary", "Origin")
+		}
+		if allowed {
+			if anyOrigin {
+				c.Header("Access-Control-Allow-Origin", "*")
+			} else {
+				c.Header("Access-Control-Allow-Origin", origin)
+			}
+			c.Header("Access-Control-Expose-Headers", "ETag, Idempotent-Replayed, Last-Modified, Retry-After, X-Request-ID, X-Result-Truncated")
+		}
+
+		// Preflights never reach the routes, which don't handle OPTIONS
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			if allowed {
+				c.Header("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE")
+				c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type, Idempotency-Key, If-Modified-Since, If-None-Match, X-API-Key, X-Request-ID")
+				c.Header("Access-Control-Max-Age", "600")
+			}
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireData answers 503 until a refresh has loaded data, so an empty
+// result on a fresh deploy isn't mistaken for a genuinely empty one.
+func requireData() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasData.Load() {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"status": "warming up",
+				"error": APIError{
+					Code:    ErrCodeWarmingUp,
+					Message: "No data loaded yet",
+					Details: "Run POST /countries/refresh or wait for the scheduled refresh",
+				},
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// gzipResponses compresses responses for clients that accept gzip once the
+// body reaches minSize bytes; smaller bodies are sent as-is. Already-encoded
+// bodies, partial content, raster images (already compressed), and event
+// streams are never compressed.
+func gzipResponses(minSize int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(c.GetHeader("Accept-Encoding")) {
+			c.Next()
+			return
+		}
+
+		gw := &gzipWriter{ResponseWriter: c.Writer, minSize: minSize}
+		c.Writer = gw
+		defer func() { c.Writer = gw.ResponseWriter }()
+
+		c.Next()
+		gw.finish()
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		// gzip;q=0 explicitly refuses it
+		if name, value, ok := strings.Cut(params, "="); ok && strings.TrimSpace(name) == "q" {
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+// gzipWriter buffers the start of a response until it knows whether the
+// body is big enough, and suitable, to compress.
+type gzipWriter struct {
+	gin.ResponseWriter
+	minSize int
+	buf     []byte
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (w *gzipWriter) Write(p []byte) (int, error) {
+	if w.decided {
+		if w.gz != nil {
+			return w.gz.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.minSize {
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// decide picks compressed or plain output and writes out the buffer.
+func (w *gzipWriter) decide() error {
+	w.decided = true
+	buf := w.buf
+	w.buf = nil
+
+	h := w.Header()
+	contentType := h.Get("Content-Type")
+	raster := strings.HasPrefix(contentType, "image/") && !strings.HasPrefix(contentType, "image/svg+xml")
+	// Event streams are flushed event by event and sent their headers early
+	stream := strings.HasPrefix(contentType, "text/event-stream")
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" || w.Status() == http.StatusPartialContent || raster || stream {
+		_, err := w.ResponseWriter.Write(buf)
+		return err
+	}
+
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+	_, err := w.gz.Write(buf)
+	return err
+}
+
+func (w *gzipWriter) Flush() {
+	if !w.decided && len(w.buf) > 0 {
+		w.decide()
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish sends a body that never reached minSize uncompressed, or closes
+// the gzip stream.
+func (w *gzipWriter) finish() {
+	if w.gz != nil {
+		w.gz.Close()
+		return
+	}
+	if !w.decided && len(w.buf) > 0 {
+		w.ResponseWriter.Write(w.buf)
+	}
+}
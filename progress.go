@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// progressEvent is one step of a refresh, sent as an SSE event named name
+// with data encoded as JSON
+type progressEvent struct {
+	name string
+	data any
+}
+
+// terminal reports whether the event ends a refresh.
+func (e progressEvent) terminal() bool {
+	return e.name == "done" || e.name == "failed"
+}
+
+// progressBuffer fits every event of one refresh: two fetches, at most 101
+// upsert steps, the image, and the final event
+const progressBuffer = 128
+
+// progressHub fans refresh progress out to /countries/refresh/stream
+// subscribers. A nil hub drops everything, for dry runs.
+type progressHub struct {
+	mu   sync.Mutex
+	subs map[chan progressEvent]struct{}
+}
+
+// refreshProgress receives the progress of every refresh
+var refreshProgress = &progressHub{subs: make(map[chan progressEvent]struct{})}
+
+// subscribe returns a channel of upcoming events and a func to stop
+// receiving them. The channel is closed when the hub shuts down.
+func (h *progressHub) subscribe() (<-chan progressEvent, func()) {
+	ch := make(chan progressEvent, progressBuffer)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		close(ch)
+		return ch, func() {}
+	}
+	h.subs[ch] = struct{}{}
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs, ch)
+	}
+}
+
+// publish sends an event to every subscriber without blocking the refresh;
+// a subscriber whose buffer is full misses it.
+func (h *progressHub) publish(name string, data any) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- progressEvent{name, data}:
+		default:
+		}
+	}
+}
+
+// upserted publishes upsert progress, only when the percentage done changes
+// so a large refresh doesn't flood subscribers.
+func (h *progressHub) upserted(done, total int) {
+	if done == total || done*100/total != (done-1)*100/total {
+		h.publish("upserted", gin.H{"done": done, "total": total})
+	}
+}
+
+// finish publishes the outcome of a refresh.
+func (h *progressHub) finish(result *RefreshResult, err error) {
+	if err == nil {
+		h.publish("done", result)
+		return
+	}
+	var refreshErr *refreshError
+	if errors.As(err, &refreshErr) {
+		h.publish("failed", APIError{Code: refreshErr.code, Message: refreshErr.message, Details: refreshErr.details})
+		return
+	}
+	h.publish("failed", APIError{Code: ErrCodeInternal, Message: "Internal server error"})
+}
+
+// close ends every subscription, so open streams don't hold up shutdown.
+func (h *progressHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		close(ch)
+	}
+	h.subs = nil
+}
+
+// streamRefreshProgress streams the progress of the running refresh, or the
+// next one to start, as Server-Sent Events. The stream ends after the done
+// or failed event.
+func streamRefreshProgress(c *gin.Context) {
+	events, unsubscribe := refreshProgress.subscribe()
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-store")
+	// Stop nginx buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	// Send the headers now so clients know the stream is open
+	c.Status(http.StatusOK)
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+			return true
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			c.SSEvent(event.name, event.data)
+			return !event.terminal()
+		}
+	})
+}